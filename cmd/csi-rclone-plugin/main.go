@@ -4,14 +4,27 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/spf13/cobra"
 	"github.com/wunderio/csi-rclone/pkg/rclone"
 )
 
 var (
-	endpoint string
-	nodeID   string
+	endpoint       string
+	nodeID         string
+	stateDir       string
+	metricsAddress string
+
+	allowedAnnotations string
+	ephemeralRemotes   string
+
+	defaultFlags        string
+	flagProfiles        string
+	printEffectiveFlags bool
+
+	healthCheckInterval time.Duration
+	quotaCheckInterval  time.Duration
 )
 
 func init() {
@@ -38,6 +51,24 @@ func main() {
 	cmd.PersistentFlags().StringVar(&endpoint, "endpoint", "", "CSI endpoint")
 	cmd.MarkPersistentFlagRequired("endpoint")
 
+	cmd.PersistentFlags().StringVar(&stateDir, "state-dir", "/var/lib/csi-rclone", "Directory where mount state is persisted across plugin restarts")
+
+	cmd.PersistentFlags().DurationVar(&healthCheckInterval, "health-check-interval", 30*time.Second, "Interval of rclone mount health checks, broken mounts are remounted (0 disables)")
+
+	cmd.PersistentFlags().DurationVar(&quotaCheckInterval, "quota-check-interval", 5*time.Minute, "Interval of the usage scans of volumes with enforceQuota, volumes over quota are made read-only (0 disables)")
+
+	cmd.PersistentFlags().StringVar(&allowedAnnotations, "allowed-annotations", rclone.DefaultAllowedAnnotations, "Comma separated rclone flags users may set with csi-rclone/<flag> PVC annotations, optionally with a validator (i.e. uid,dir-cache-time,transfers=int(1-8)), StorageClass allowedAnnotations parameter overrides it")
+
+	cmd.PersistentFlags().StringVar(&ephemeralRemotes, "ephemeral-remotes", "", "Comma separated rclone backends inline ephemeral volumes of pods may use (i.e. s3,webdav), inline volumes are refused when empty")
+
+	cmd.PersistentFlags().StringVar(&defaultFlags, "default-flags", rclone.DefaultMountFlags, "Comma separated rclone flags of all mounts (i.e. vfs-cache-mode=writes,dir-cache-time=5s), overridden by the secrets and volume flags")
+
+	cmd.PersistentFlags().StringVar(&flagProfiles, "flag-profiles", "", "YAML file with default rclone flags and named flag profiles selected by the flagProfile StorageClass parameter")
+
+	cmd.PersistentFlags().BoolVar(&printEffectiveFlags, "print-effective-flags", false, "Log the rclone flags of every mount with their source, secret values are redacted")
+
+	cmd.PersistentFlags().StringVar(&metricsAddress, "metrics-address", "", "Address to serve Prometheus metrics on (i.e. :9811), disabled when empty")
+
 	versionCmd := &cobra.Command{
 		Use:   "version",
 		Short: "Prints information about this version of csi rclone plugin",
@@ -61,6 +92,9 @@ Version:    %s
 }
 
 func handle() {
-	d := rclone.NewDriver(nodeID, endpoint)
+	d := rclone.NewDriver(nodeID, endpoint, stateDir, healthCheckInterval, quotaCheckInterval, allowedAnnotations, ephemeralRemotes, defaultFlags, flagProfiles, printEffectiveFlags)
+	if metricsAddress != "" {
+		d.ServeMetrics(metricsAddress)
+	}
 	d.Run()
 }
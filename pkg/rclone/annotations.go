@@ -0,0 +1,228 @@
+package rclone
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// PVC annotations with this prefix set rclone flags of the volume, if the flag is allowed
+const annotationPrefix = "csi-rclone/"
+
+// DefaultAllowedAnnotations is what users could set before the allowlist was configurable
+const DefaultAllowedAnnotations = "umask"
+
+// flagValidator returns an error describing why a flag value is not accepted
+type flagValidator func(value string) error
+
+// builtinValidators are used for allowed annotations listed without a validator
+var builtinValidators = map[string]flagValidator{
+	"umask":                intRangeValidator(0, 0777, 8),
+	"uid":                  intRangeValidator(0, 1<<32-1, 10),
+	"gid":                  intRangeValidator(0, 1<<32-1, 10),
+	"read-only":            boolValidator,
+	"vfs-cache-mode":       enumValidator([]string{"off", "minimal", "writes", "full"}),
+	"dir-cache-time":       durationValidator,
+	"attr-timeout":         durationValidator,
+	"poll-interval":        durationValidator,
+	"vfs-cache-max-age":    durationValidator,
+	"vfs-write-back":       durationValidator,
+	"vfs-cache-max-size":   sizeValidator,
+	"vfs-read-chunk-size":  sizeValidator,
+	"buffer-size":          sizeValidator,
+	"transfers":            intRangeValidator(1, 64, 10),
+	"checkers":             intRangeValidator(1, 64, 10),
+	"no-modtime":           boolValidator,
+	"vfs-fast-fingerprint": boolValidator,
+}
+
+// Volume context keys that are not rclone flags, users must not override them
+var reservedAnnotationFlags = map[string]bool{
+	"remote":                              true,
+	"remotePath":                          true,
+	"remotePathSuffix":                    true,
+	"configData":                          true,
+	"onDelete":                            true,
+	inheritRcloneSecretParameter:          true,
+	encryptionParameter:                   true,
+	encryptionKeySecretNameParameter:      true,
+	encryptionKeySecretNamespaceParameter: true,
+	capacityParameter:                     true,
+	enforceQuotaParameter:                 true,
+	podIdentityParameter:                  true,
+	flagProfileParameter:                  true,
+	tokenAudienceParameter:                true,
+	tokenProviderParameter:                true,
+	awsRoleArnParameter:                   true,
+	azureClientIDParameter:                true,
+	azureTenantIDParameter:                true,
+	gcpCredentialConfigParameter:          true,
+}
+
+var (
+	validatorSpecPattern = regexp.MustCompile(`^(int|enum)\((.*)\)$`)
+	intRangePattern      = regexp.MustCompile(`^(\d+)-(\d+)$`)
+	// rclone durations also accept days, weeks, months and years, see https://rclone.org/docs/#time-option
+	rcloneDurationPattern = regexp.MustCompile(`^\d+(\.\d+)?(d|w|M|y)$`)
+	// see https://rclone.org/docs/#size-option
+	rcloneSizePattern = regexp.MustCompile(`^(?i:off|\d+(\.\d+)?([bkmgtpe](i?b)?)?)$`)
+)
+
+// parseAllowedAnnotations parses a comma separated list of rclone flags users may set with
+// csi-rclone/<flag> PVC annotations. Flags are validated by a builtin validator, or by the
+// validator given after "=": int(min-max), enum(a|b|c), duration, size or bool.
+func parseAllowedAnnotations(allowlist string) (map[string]flagValidator, error) {
+	allowed := map[string]flagValidator{}
+
+	for _, entry := range strings.Split(allowlist, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+
+		flag, spec := entry, ""
+		if i := strings.Index(entry, "="); i >= 0 {
+			flag, spec = strings.TrimSpace(entry[:i]), strings.TrimSpace(entry[i+1:])
+		}
+
+		if reservedAnnotationFlags[flag] {
+			return nil, fmt.Errorf("%q is not an rclone flag and can not be set with annotations", flag)
+		}
+
+		var validator flagValidator
+		if spec == "" {
+			var ok bool
+			if validator, ok = builtinValidators[flag]; !ok {
+				return nil, fmt.Errorf("no builtin validator for annotation flag %q, set one with %s=<validator>", flag, flag)
+			}
+		} else {
+			var err error
+			if validator, err = parseValidator(spec); err != nil {
+				return nil, fmt.Errorf("invalid validator of annotation flag %q: %v", flag, err)
+			}
+		}
+
+		allowed[flag] = validator
+	}
+
+	return allowed, nil
+}
+
+func parseValidator(spec string) (flagValidator, error) {
+	switch spec {
+	case "duration":
+		return durationValidator, nil
+	case "size":
+		return sizeValidator, nil
+	case "bool":
+		return boolValidator, nil
+	}
+
+	match := validatorSpecPattern.FindStringSubmatch(spec)
+	if match == nil {
+		return nil, fmt.Errorf("unknown validator %q", spec)
+	}
+
+	switch match[1] {
+	case "int":
+		bounds := intRangePattern.FindStringSubmatch(match[2])
+		if bounds == nil {
+			return nil, fmt.Errorf("invalid int range %q, must be int(min-max)", match[2])
+		}
+		min, _ := strconv.ParseInt(bounds[1], 10, 64)
+		max, _ := strconv.ParseInt(bounds[2], 10, 64)
+		if min > max {
+			return nil, fmt.Errorf("invalid int range %q, min is greater than max", match[2])
+		}
+		return intRangeValidator(min, max, 10), nil
+	default:
+		values := strings.Split(match[2], "|")
+		for _, value := range values {
+			if value == "" {
+				return nil, fmt.Errorf("invalid enum %q, values must not be empty", match[2])
+			}
+		}
+		return enumValidator(values), nil
+	}
+}
+
+// annotationFlags returns the rclone flags set by allowed csi-rclone/<flag> annotations
+func annotationFlags(annotations map[string]string, allowed map[string]flagValidator) (map[string]string, error) {
+	flags := map[string]string{}
+
+	for key, value := range annotations {
+		if !strings.HasPrefix(key, annotationPrefix) {
+			continue
+		}
+		flag := strings.TrimPrefix(key, annotationPrefix)
+
+		validator, ok := allowed[flag]
+		if !ok {
+			// other csi-rclone annotations may be used by the pathPattern
+			continue
+		}
+		if err := validator(value); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid value %q of annotation %s: %s", value, key, err)
+		}
+
+		flags[flag] = value
+	}
+
+	return flags, nil
+}
+
+func intRangeValidator(min int64, max int64, base int) flagValidator {
+	return func(value string) error {
+		i, err := strconv.ParseInt(value, base, 64)
+		if err != nil {
+			return fmt.Errorf("not a base %d integer", base)
+		}
+		if i < min || i > max {
+			if base == 8 {
+				return fmt.Errorf("must be between %o and %o", min, max)
+			}
+			return fmt.Errorf("must be between %d and %d", min, max)
+		}
+		return nil
+	}
+}
+
+func enumValidator(values []string) flagValidator {
+	return func(value string) error {
+		for _, v := range values {
+			if value == v {
+				return nil
+			}
+		}
+		return fmt.Errorf("must be one of %s", strings.Join(values, ", "))
+	}
+}
+
+func durationValidator(value string) error {
+	if value == "off" || rcloneDurationPattern.MatchString(value) {
+		return nil
+	}
+	if _, err := time.ParseDuration(value); err != nil {
+		return fmt.Errorf("not a duration (i.e. 30s, 5m, 1h, 2d)")
+	}
+	return nil
+}
+
+func sizeValidator(value string) error {
+	if !rcloneSizePattern.MatchString(value) {
+		return fmt.Errorf("not a size (i.e. 512M, 10G, off)")
+	}
+	return nil
+}
+
+func boolValidator(value string) error {
+	if _, err := strconv.ParseBool(value); err != nil {
+		return fmt.Errorf("must be true or false")
+	}
+	return nil
+}
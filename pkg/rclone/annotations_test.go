@@ -0,0 +1,166 @@
+package rclone
+
+import (
+	"reflect"
+	"sort"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseAllowedAnnotations(t *testing.T) {
+	tests := []struct {
+		allowlist string
+		want      []string
+		wantErr   bool
+	}{
+		{"", []string{}, false},
+		{DefaultAllowedAnnotations, []string{"umask"}, false},
+		{" umask , vfs-cache-mode,,dir-cache-time ", []string{"dir-cache-time", "umask", "vfs-cache-mode"}, false},
+		{"vfs-read-ahead=size,s3-chunk-size = size", []string{"s3-chunk-size", "vfs-read-ahead"}, false},
+		{"multi-thread-streams=int(0-16),s3-storage-class=enum(STANDARD|GLACIER)", []string{"multi-thread-streams", "s3-storage-class"}, false},
+		{"vfs-write-wait=duration,no-checksum=bool", []string{"no-checksum", "vfs-write-wait"}, false},
+		{"vfs-read-ahead", nil, true},
+		{"remotePath", nil, true},
+		{"configData=size", nil, true},
+		{"encryption=bool", nil, true},
+		{"transfers=number", nil, true},
+		{"transfers=int(16-1)", nil, true},
+		{"transfers=int(1)", nil, true},
+		{"transfers=int(a-b)", nil, true},
+		{"s3-storage-class=enum(STANDARD||GLACIER)", nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseAllowedAnnotations(test.allowlist)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseAllowedAnnotations(%q) error = %v, want error %v", test.allowlist, err, test.wantErr)
+			continue
+		}
+		if test.wantErr {
+			continue
+		}
+		flags := []string{}
+		for flag := range got {
+			flags = append(flags, flag)
+		}
+		sort.Strings(flags)
+		if !reflect.DeepEqual(flags, test.want) {
+			t.Errorf("parseAllowedAnnotations(%q) allows %v, want %v", test.allowlist, flags, test.want)
+		}
+	}
+}
+
+func TestParsedValidators(t *testing.T) {
+	allowed, err := parseAllowedAnnotations("umask,multi-thread-streams=int(0-16),s3-storage-class=enum(STANDARD|GLACIER),vfs-read-ahead=size,vfs-write-wait=duration,no-checksum=bool")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		flag  string
+		value string
+		valid bool
+	}{
+		{"umask", "022", true},
+		{"umask", "0777", true},
+		{"umask", "1000", false},
+		{"umask", "8", false},
+		{"multi-thread-streams", "0", true},
+		{"multi-thread-streams", "16", true},
+		{"multi-thread-streams", "17", false},
+		{"multi-thread-streams", "-1", false},
+		{"s3-storage-class", "GLACIER", true},
+		{"s3-storage-class", "glacier", false},
+		{"s3-storage-class", "", false},
+		{"vfs-read-ahead", "256M", true},
+		{"vfs-write-wait", "10s", true},
+		{"no-checksum", "true", true},
+		{"no-checksum", "yes", false},
+	}
+
+	for _, test := range tests {
+		if err := allowed[test.flag](test.value); (err == nil) != test.valid {
+			t.Errorf("validator of %s(%q) = %v, want valid %v", test.flag, test.value, err, test.valid)
+		}
+	}
+}
+
+func TestValidators(t *testing.T) {
+	tests := []struct {
+		name      string
+		validator flagValidator
+		value     string
+		valid     bool
+	}{
+		{"int", intRangeValidator(1, 64, 10), "1", true},
+		{"int", intRangeValidator(1, 64, 10), "64", true},
+		{"int", intRangeValidator(1, 64, 10), "0", false},
+		{"int", intRangeValidator(1, 64, 10), "65", false},
+		{"int", intRangeValidator(1, 64, 10), "4.5", false},
+		{"int", intRangeValidator(1, 64, 10), "", false},
+		{"octal", intRangeValidator(0, 0777, 8), "0755", true},
+		{"octal", intRangeValidator(0, 0777, 8), "755", true},
+		{"octal", intRangeValidator(0, 0777, 8), "0799", false},
+		{"enum", enumValidator([]string{"off", "full"}), "full", true},
+		{"enum", enumValidator([]string{"off", "full"}), "Full", false},
+		{"duration", durationValidator, "30s", true},
+		{"duration", durationValidator, "1h30m", true},
+		{"duration", durationValidator, "2d", true},
+		{"duration", durationValidator, "1.5w", true},
+		{"duration", durationValidator, "1M", true},
+		{"duration", durationValidator, "off", true},
+		{"duration", durationValidator, "5", false},
+		{"duration", durationValidator, "5 minutes", false},
+		{"size", sizeValidator, "512M", true},
+		{"size", sizeValidator, "10G", true},
+		{"size", sizeValidator, "1.5G", true},
+		{"size", sizeValidator, "1GiB", true},
+		{"size", sizeValidator, "1024", true},
+		{"size", sizeValidator, "off", true},
+		{"size", sizeValidator, "OFF", true},
+		{"size", sizeValidator, "-1", false},
+		{"size", sizeValidator, "10X", false},
+		{"size", sizeValidator, "", false},
+		{"bool", boolValidator, "true", true},
+		{"bool", boolValidator, "0", true},
+		{"bool", boolValidator, "on", false},
+	}
+
+	for _, test := range tests {
+		if err := test.validator(test.value); (err == nil) != test.valid {
+			t.Errorf("%s validator(%q) = %v, want valid %v", test.name, test.value, err, test.valid)
+		}
+	}
+}
+
+func TestAnnotationFlags(t *testing.T) {
+	allowed, err := parseAllowedAnnotations("umask,vfs-cache-mode")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		annotations map[string]string
+		want        map[string]string
+		code        codes.Code
+	}{
+		{nil, map[string]string{}, codes.OK},
+		{map[string]string{"csi-rclone/umask": "002", "csi-rclone/vfs-cache-mode": "full"}, map[string]string{"umask": "002", "vfs-cache-mode": "full"}, codes.OK},
+		{map[string]string{"csi-rclone/team": "a", "csi-rclone/uid": "0", "umask": "000"}, map[string]string{}, codes.OK},
+		{map[string]string{"csi-rclone/umask": "999"}, nil, codes.InvalidArgument},
+		{map[string]string{"csi-rclone/vfs-cache-mode": "all"}, nil, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		got, err := annotationFlags(test.annotations, allowed)
+		if code := status.Code(err); code != test.code {
+			t.Errorf("annotationFlags(%v) = %v, want code %v", test.annotations, err, test.code)
+			continue
+		}
+		if test.code == codes.OK && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("annotationFlags(%v) = %v, want %v", test.annotations, got, test.want)
+		}
+	}
+}
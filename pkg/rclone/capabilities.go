@@ -0,0 +1,92 @@
+package rclone
+
+import (
+	"fmt"
+	"strconv"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// checkVolumeCapabilities returns why a capability is not supported, rclone volumes are filesystems only
+func checkVolumeCapabilities(capabilities []*csi.VolumeCapability, supported []*csi.VolumeCapability_AccessMode) error {
+	for _, capability := range capabilities {
+		if capability.GetBlock() != nil {
+			return fmt.Errorf("block volumes are not supported")
+		}
+		if capability.GetMount() == nil {
+			return fmt.Errorf("missing mount access type")
+		}
+
+		mode := capability.GetAccessMode().GetMode()
+		found := false
+		for _, accessMode := range supported {
+			if accessMode.GetMode() == mode {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("access mode %s is not supported", mode)
+		}
+	}
+
+	return nil
+}
+
+// isReadOnlyAccessMode returns whether the capability only allows reading (ReadOnlyMany)
+func isReadOnlyAccessMode(capability *csi.VolumeCapability) bool {
+	switch capability.GetAccessMode().GetMode() {
+	case csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY, csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY:
+		return true
+	}
+	return false
+}
+
+// isReadOnlyFlag returns whether the rclone flags make the mount read-only
+func isReadOnlyFlag(flags map[string]string) bool {
+	value, ok := flags["read-only"]
+	if !ok {
+		return false
+	}
+	// A flag without value is set
+	readOnly, err := strconv.ParseBool(value)
+	return value == "" || (err == nil && readOnly)
+}
+
+func (cs *controllerServer) ValidateVolumeCapabilities(ctx context.Context, req *csi.ValidateVolumeCapabilitiesRequest) (resp *csi.ValidateVolumeCapabilitiesResponse, err error) {
+	defer func(start time.Time) { observeOperation("ValidateVolumeCapabilities", start, err) }(time.Now())
+
+	volumeId := req.GetVolumeId()
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume ID must be provided")
+	}
+	if len(req.GetVolumeCapabilities()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "ValidateVolumeCapabilities Volume Capabilities must be provided")
+	}
+
+	pv, err := getPersistentVolume(volumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can not load PV of volume %s: %s", volumeId, err)
+	}
+	if pv == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeId)
+	}
+
+	if err := checkVolumeCapabilities(req.GetVolumeCapabilities(), cs.Driver.GetVolumeCapabilityAccessModes()); err != nil {
+		glog.V(4).Infof("Volume %s does not support the requested capabilities: %s", volumeId, err)
+		return &csi.ValidateVolumeCapabilitiesResponse{Message: err.Error()}, nil
+	}
+
+	return &csi.ValidateVolumeCapabilitiesResponse{
+		Confirmed: &csi.ValidateVolumeCapabilitiesResponse_Confirmed{
+			VolumeContext:      req.GetVolumeContext(),
+			VolumeCapabilities: req.GetVolumeCapabilities(),
+			Parameters:         req.GetParameters(),
+		},
+	}, nil
+}
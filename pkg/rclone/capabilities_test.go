@@ -0,0 +1,96 @@
+package rclone
+
+import (
+	"testing"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+)
+
+func mountCapability(mode csi.VolumeCapability_AccessMode_Mode) *csi.VolumeCapability {
+	return &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Mount{Mount: &csi.VolumeCapability_MountVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: mode},
+	}
+}
+
+func TestCheckVolumeCapabilities(t *testing.T) {
+	supported := []*csi.VolumeCapability_AccessMode{
+		{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+		{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY},
+	}
+	block := &csi.VolumeCapability{
+		AccessType: &csi.VolumeCapability_Block{Block: &csi.VolumeCapability_BlockVolume{}},
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+	noAccessType := &csi.VolumeCapability{
+		AccessMode: &csi.VolumeCapability_AccessMode{Mode: csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER},
+	}
+
+	tests := []struct {
+		name         string
+		capabilities []*csi.VolumeCapability
+		wantErr      bool
+	}{
+		{"none", nil, false},
+		{"supported mode", []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER)}, false},
+		{"supported modes", []*csi.VolumeCapability{
+			mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY),
+		}, false},
+		{"unsupported mode", []*csi.VolumeCapability{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER)}, true},
+		{"one unsupported mode", []*csi.VolumeCapability{
+			mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER),
+			mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER),
+		}, true},
+		{"block", []*csi.VolumeCapability{block}, true},
+		{"no access type", []*csi.VolumeCapability{noAccessType}, true},
+	}
+
+	for _, test := range tests {
+		err := checkVolumeCapabilities(test.capabilities, supported)
+		if (err != nil) != test.wantErr {
+			t.Errorf("%s: checkVolumeCapabilities() = %v, want error %v", test.name, err, test.wantErr)
+		}
+	}
+}
+
+func TestIsReadOnlyAccessMode(t *testing.T) {
+	tests := []struct {
+		capability *csi.VolumeCapability
+		want       bool
+	}{
+		{nil, false},
+		{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY), true},
+		{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY), true},
+		{mountCapability(csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER), false},
+		{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER), false},
+		{mountCapability(csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER), false},
+	}
+
+	for _, test := range tests {
+		if got := isReadOnlyAccessMode(test.capability); got != test.want {
+			t.Errorf("isReadOnlyAccessMode(%v) = %v, want %v", test.capability, got, test.want)
+		}
+	}
+}
+
+func TestIsReadOnlyFlag(t *testing.T) {
+	tests := []struct {
+		flags map[string]string
+		want  bool
+	}{
+		{nil, false},
+		{map[string]string{"vfs-cache-mode": "full"}, false},
+		{map[string]string{"read-only": ""}, true},
+		{map[string]string{"read-only": "true"}, true},
+		{map[string]string{"read-only": "1"}, true},
+		{map[string]string{"read-only": "false"}, false},
+		{map[string]string{"read-only": "maybe"}, false},
+	}
+
+	for _, test := range tests {
+		if got := isReadOnlyFlag(test.flags); got != test.want {
+			t.Errorf("isReadOnlyFlag(%v) = %v, want %v", test.flags, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,58 @@
+package rclone
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+)
+
+// rclone config files hold backend credentials. They are written to a per-mount directory
+// only readable by root and removed as soon as rclone has read them or the volume is unpublished.
+
+// mountConfigDir returns the config directory of the mount at targetPath
+func mountConfigDir(stateDir string, targetPath string) string {
+	return filepath.Join(stateDir, "config", mountID(targetPath))
+}
+
+// writeConfigFile writes configData to rclone.conf in dir and returns the file path
+func writeConfigFile(dir string, configData string) (string, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return "", err
+	}
+	// MkdirAll keeps the mode of an existing directory
+	if err := os.Chmod(dir, 0700); err != nil {
+		return "", err
+	}
+
+	configFile := filepath.Join(dir, "rclone.conf")
+
+	// WriteFile applies the mode to new files only
+	os.Remove(configFile)
+	if err := ioutil.WriteFile(configFile, []byte(configData), 0600); err != nil {
+		return "", err
+	}
+
+	return configFile, nil
+}
+
+// removeConfigDir deletes the config directory of a mount
+func removeConfigDir(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		glog.Warningf("cannot remove rclone config directory %s: %v", dir, err)
+	}
+}
+
+// sweepConfigFiles removes config files left behind by crashed nodeplugins, rclone reads
+// its config on startup so running mounts do not need them anymore
+func sweepConfigFiles(stateDir string) {
+	removeConfigDir(filepath.Join(stateDir, "config"))
+
+	// Earlier versions wrote config files to the temp directory and never removed them
+	orphans, _ := filepath.Glob(filepath.Join(os.TempDir(), "rclone.conf*"))
+	for _, orphan := range orphans {
+		glog.V(4).Infof("removing orphaned rclone config file %s", orphan)
+		os.Remove(orphan)
+	}
+}
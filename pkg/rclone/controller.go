@@ -1,8 +1,14 @@
 package rclone
 
 import (
+	"fmt"
+	"reflect"
 	"regexp"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
@@ -16,32 +22,105 @@ import (
 
 type controllerServer struct {
 	*csicommon.DefaultControllerServer
+
+	// Flags users may set with PVC annotations, unless the StorageClass sets allowedAnnotations
+	allowedAnnotations map[string]flagValidator
+
+	// Names of volumes and snapshots with an operation in progress, retried calls must not start another
+	// one. Copies running in the background are stopped with their cancel function.
+	operations map[string]context.CancelFunc
+	mu         sync.Mutex
+
+	// Populate records left behind by a previous controller are swept once
+	sweepPopulateOnce sync.Once
 }
 
-type pvcMetadata struct {
-	data        map[string]string
-	labels      map[string]string
-	annotations map[string]string
+// startOperation marks an operation on name for the duration of a call, it returns false if one is already running
+func (cs *controllerServer) startOperation(name string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.operations[name]; ok {
+		return false
+	}
+	cs.operations[name] = nil
+	return true
 }
 
-// source: https://github.com/kubernetes-sigs/nfs-subdir-external-provisioner/blob/master/cmd/nfs-subdir-external-provisioner/provisioner.go
-var pattern = regexp.MustCompile(`\${\.PVC\.((labels|annotations)\.(.*?)|.*?)}`)
+// startBackgroundOperation marks a copy on name that keeps running after the call returned, bounded by
+// copyTimeout. It returns false if an operation is already running.
+func (cs *controllerServer) startBackgroundOperation(name string) (context.Context, bool) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if _, ok := cs.operations[name]; ok {
+		return nil, false
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), copyTimeout)
+	cs.operations[name] = cancel
+	return ctx, true
+}
 
-// source: https://github.com/kubernetes-sigs/nfs-subdir-external-provisioner/blob/master/cmd/nfs-subdir-external-provisioner/provisioner.go
-func (meta *pvcMetadata) stringParser(str string) string {
-	result := pattern.FindAllStringSubmatch(str, -1)
-	for _, r := range result {
-		switch r[2] {
-		case "labels":
-			str = strings.ReplaceAll(str, r[0], meta.labels[r[3]])
-		case "annotations":
-			str = strings.ReplaceAll(str, r[0], meta.annotations[r[3]])
-		default:
-			str = strings.ReplaceAll(str, r[0], meta.data[r[1]])
-		}
+func (cs *controllerServer) finishOperation(name string) {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	if cancel := cs.operations[name]; cancel != nil {
+		cancel()
 	}
+	delete(cs.operations, name)
+}
+
+// cancelOperation stops the background copy on name, it returns false if none is running
+func (cs *controllerServer) cancelOperation(name string) bool {
+	cs.mu.Lock()
+	defer cs.mu.Unlock()
+	cancel := cs.operations[name]
+	if cancel == nil {
+		return false
+	}
+	cancel()
+	return true
+}
+
+// StorageClass parameter onDelete values, controlling what DeleteVolume does with the remote path
+const (
+	onDeleteRetain  = "retain"
+	onDeleteDelete  = "delete"
+	onDeleteArchive = "archive"
+)
+
+const (
+	// Archives and snapshots are kept in <remotePath>/.csi-rclone, next to the volumes but out of
+	// reach of pathPattern paths, normalizePathSuffix refuses this directory
+	reservedDir = ".csi-rclone"
+	archiveDir  = reservedDir + "/archive"
+)
+
+// StorageClass parameters consumed by the controller, all other parameters are rclone flags
+var provisionerParameters = map[string]bool{
+	"pathPattern":        true,
+	"onDelete":           true,
+	"allowExisting":      true,
+	"allowedAnnotations": true,
+	"exclusivePath":      true,
+}
+
+func isProvisionerParameter(key string) bool {
+	// parameters provided by external-provisioner (csi-provisioner)
+	return provisionerParameters[key] || strings.HasPrefix(key, "csi.storage.k8s.io/")
+}
+
+// Names of rclone flags, with or without "--", i.e. s3-endpoint or vfs_cache_mode
+var rcloneFlagNamePattern = regexp.MustCompile(`^(--)?[a-z0-9]+([-_][a-z0-9]+)*$`)
 
-	return str
+// validateVolumeParameter checks a StorageClass parameter passed to the mounts, it must be a volume
+// context key of the driver or look like an rclone flag. Misspelled flags are still passed to rclone.
+func validateVolumeParameter(key string) error {
+	if key == "remotePathSuffix" {
+		return status.Errorf(codes.InvalidArgument, "parameter %s is set by the provisioner, use pathPattern", key)
+	}
+	if reservedAnnotationFlags[key] || rcloneFlagNamePattern.MatchString(key) {
+		return nil
+	}
+	return status.Errorf(codes.InvalidArgument, "parameter %q is neither a csi-rclone parameter nor an rclone flag", key)
 }
 
 func (cs *controllerServer) getPVC(name, namespace string) (*v1.PersistentVolumeClaim, error) {
@@ -60,16 +139,69 @@ func (cs *controllerServer) getPVC(name, namespace string) (*v1.PersistentVolume
 	return pvc, nil
 }
 
-func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (*csi.CreateVolumeResponse, error) {
+// getRemoteFlags merges the default secret, request secrets and volume context into rclone flags,
+// the same way the node server does before mounting
+func (cs *controllerServer) getRemoteFlags(volumeContext map[string]string, secrets map[string]string) (string, string, string, map[string]string, error) {
+	// Load default connection settings from secret, the controller uses them for pod identity and
+	// token federation volumes too, it has no pod to take credentials from
+	secret := getDefaultSecret(volumeContext, secrets)
+
+	// Secrets referenced by StorageClass csi.storage.k8s.io/provisioner-secret-name
+	return extractFlags(volumeContext, secret, secrets, nil, nil)
+}
+
+func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVolumeRequest) (resp *csi.CreateVolumeResponse, err error) {
+	defer func(start time.Time) { observeOperation("CreateVolume", start, err) }(time.Now())
+
 	// Parse the request to get the volume name, size, and parameters.
 	volumeName := req.GetName()
 	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
 
+	if err := checkVolumeCapabilities(req.GetVolumeCapabilities(), cs.Driver.GetVolumeCapabilityAccessModes()); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "unsupported volume capability: %s", err)
+	}
+
 	// Extract parameters from the request
 	parameters := req.GetParameters()
 
 	volumeContext := map[string]string{}
 
+	// rclone flags from the StorageClass are passed to the node server in the volume context
+	for key, value := range parameters {
+		if isProvisionerParameter(key) {
+			continue
+		}
+		if err := validateVolumeParameter(key); err != nil {
+			return nil, err
+		}
+		volumeContext[key] = value
+	}
+
+	allowExisting := false
+	if val, ok := parameters["allowExisting"]; ok && val != "" {
+		var err error
+		if allowExisting, err = strconv.ParseBool(val); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid allowExisting parameter %q: %s", val, err)
+		}
+	}
+
+	exclusivePath := false
+	if val, ok := parameters["exclusivePath"]; ok && val != "" {
+		var err error
+		if exclusivePath, err = strconv.ParseBool(val); err != nil {
+			return nil, status.Errorf(codes.InvalidArgument, "invalid exclusivePath parameter %q: %s", val, err)
+		}
+	}
+
+	if onDelete, ok := parameters["onDelete"]; ok && onDelete != "" {
+		switch onDelete {
+		case onDeleteRetain, onDeleteDelete, onDeleteArchive:
+			volumeContext["onDelete"] = onDelete
+		default:
+			return nil, status.Errorf(codes.InvalidArgument, "invalid onDelete parameter %q, must be one of: %s, %s, %s", onDelete, onDeleteRetain, onDeleteDelete, onDeleteArchive)
+		}
+	}
+
 	pvcName := ""
 	pvcNamespace := ""
 
@@ -83,6 +215,11 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 		pvcNamespace = val
 	}
 
+	// Without the PVC the pathPattern can not be resolved, all volumes would share remotePath
+	if pvcName == "" && parameters["pathPattern"] != "" {
+		return nil, status.Error(codes.InvalidArgument, "pathPattern requires PVC metadata, run csi-provisioner with --extra-create-metadata")
+	}
+
 	// If PVC name is provided, load the PVC definition
 	if pvcName != "" {
 
@@ -92,38 +229,128 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			return nil, err
 		}
 
-		// Extract PVC metadata
-		metadata := &pvcMetadata{
-			data: map[string]string{
-				"name":      pvcName,
-				"namespace": pvcNamespace,
-			},
-			labels:      pvc.Labels,
-			annotations: pvc.Annotations,
+		if pathPattern := parameters["pathPattern"]; pathPattern != "" {
+			template := &pathTemplate{
+				pvc: pvc,
+				// parameter provided by external-provisioner (csi-provisioner)
+				pvName: parameters["csi.storage.k8s.io/pv/name"],
+			}
+			if pvc.Spec.StorageClassName != nil {
+				template.storageClassName = *pvc.Spec.StorageClassName
+			}
+
+			remotePathSuffix, err := template.render(pathPattern)
+			if err != nil {
+				return nil, err
+			}
+			// Annotation values end up in the path, they must not reach data of other volumes
+			if remotePathSuffix, err = normalizePathSuffix(remotePathSuffix); err != nil {
+				return nil, err
+			}
+			volumeContext["remotePathSuffix"] = remotePathSuffix
 		}
 
-		if pathPattern, ok := parameters["pathPattern"]; ok {
-			if pathPattern != "" {
-				remotePathSuffix := metadata.stringParser(pathPattern)
-				if remotePathSuffix != "" {
-					if !strings.HasPrefix(remotePathSuffix, "/") {
-						remotePathSuffix = "/" + remotePathSuffix
-					}
-					volumeContext["remotePathSuffix"] = remotePathSuffix
-				}
+		// Only flags allowed by the admin can be set with "csi-rclone/<flag>" annotations, they override StorageClass flags
+		allowed := cs.allowedAnnotations
+		if allowlist, ok := parameters["allowedAnnotations"]; ok {
+			if allowed, err = parseAllowedAnnotations(allowlist); err != nil {
+				return nil, status.Errorf(codes.InvalidArgument, "invalid allowedAnnotations parameter: %s", err)
 			}
 		}
+		flags, err := annotationFlags(pvc.Annotations, allowed)
+		if err != nil {
+			return nil, err
+		}
+		for key, value := range flags {
+			volumeContext[key] = value
+		}
+	}
 
-		// if Annotation starts with "csi-rclone/", extract the key and value from the annotation
-		for key, value := range metadata.annotations {
-			if strings.HasPrefix(key, "csi-rclone/") {
-				key = strings.TrimPrefix(key, "csi-rclone/")
+	if err := validateEncryption(volumeContext[encryptionParameter]); err != nil {
+		return nil, err
+	}
 
-				// Only allow some keys (umask, uid) to be passed to the volume context to avoid security issues
-				if key == "umask" {
-					volumeContext[key] = value
-				}
-			}
+	// The node limits the mount to the requested capacity
+	if capacityBytes > 0 {
+		volumeContext[capacityParameter] = strconv.FormatInt(capacityBytes, 10)
+	}
+	if _, _, err := parseCapacity(volumeContext); err != nil {
+		return nil, err
+	}
+
+	// Deleting or archiving without a per-volume path would remove data shared by all volumes
+	if onDelete := volumeContext["onDelete"]; onDelete != "" && onDelete != onDeleteRetain && volumeContext["remotePathSuffix"] == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "onDelete %s requires a pathPattern resolving to a non-empty path", onDelete)
+	}
+
+	// Two claims resolving to the same path would silently share their data
+	if exclusivePath && volumeContext["remotePathSuffix"] != "" {
+		owner, err := findPathOwner(volumeName, volumeContext)
+		if err != nil {
+			return nil, err
+		}
+		if owner != "" {
+			return nil, status.Errorf(codes.AlreadyExists, "remote path %s%s of volume %s overlaps with the path of volume %s", volumeContext["remotePath"], volumeContext["remotePathSuffix"], volumeName, owner)
+		}
+	}
+
+	// Volumes restored from a snapshot or cloned from a volume are populated with a copy of its data
+	var sourceContext, sourceSecrets map[string]string
+	var populate *populateRecord
+	if contentSource := req.GetVolumeContentSource(); contentSource != nil {
+		// Copies of PVCs deleted while the controller was down are not resumed by anyone
+		go cs.sweepPopulateOnce.Do(cs.sweepPopulateRecords)
+
+		if sourceContext, sourceSecrets, err = cs.getContentSourceContext(contentSource); err != nil {
+			return nil, err
+		}
+		// A retried call finds the data copied so far by the previous ones
+		if populate, err = getPopulateRecord(volumeName); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := cs.createRemotePath(ctx, volumeName, volumeContext, req.GetSecrets(), allowExisting || populate != nil); err != nil {
+		return nil, err
+	}
+
+	// Encrypted data is copied as is, the volume needs the key of its source
+	if sourceContext[encryptionParameter] == encryptionCrypt {
+		sourceKey, err := getCryptKeySecret(sourceContext)
+		if err != nil {
+			return nil, err
+		}
+		namespace, err := cryptKeySecretNamespace(volumeContext)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := createCryptKeySecret(volumeName, namespace, sourceKey)
+		if err != nil {
+			return nil, err
+		}
+		volumeContext[encryptionParameter] = encryptionCrypt
+		volumeContext[encryptionKeySecretNameParameter] = secret.Name
+		volumeContext[encryptionKeySecretNamespaceParameter] = secret.Namespace
+	}
+
+	// Every encrypted volume gets its own key, referenced by the volume context
+	if volumeContext[encryptionParameter] == encryptionCrypt && volumeContext[encryptionKeySecretNameParameter] == "" {
+		namespace, err := cryptKeySecretNamespace(volumeContext)
+		if err != nil {
+			return nil, err
+		}
+		secret, err := createCryptKeySecret(volumeName, namespace, nil)
+		if err != nil {
+			return nil, err
+		}
+		volumeContext[encryptionKeySecretNameParameter] = secret.Name
+		volumeContext[encryptionKeySecretNamespaceParameter] = secret.Namespace
+	}
+
+	// The copy runs in the background, provisioning is retried until it has finished
+	if sourceContext != nil {
+		if err := cs.populateVolume(volumeName, pvcName, pvcNamespace, populate, sourceContext, sourceSecrets, volumeContext, req.GetSecrets()); err != nil {
+			return nil, err
 		}
 	}
 
@@ -132,10 +359,348 @@ func (cs *controllerServer) CreateVolume(ctx context.Context, req *csi.CreateVol
 			VolumeId:      volumeName,
 			CapacityBytes: capacityBytes,
 			VolumeContext: volumeContext,
+			ContentSource: req.GetVolumeContentSource(),
 		},
 	}, nil
 }
 
-func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (*csi.DeleteVolumeResponse, error) {
+// getContentSourceContext returns the volume context and the secrets addressing the data a new volume is
+// populated with
+func (cs *controllerServer) getContentSourceContext(contentSource *csi.VolumeContentSource) (map[string]string, map[string]string, error) {
+	if snapshot := contentSource.GetSnapshot(); snapshot != nil {
+		record, err := getSnapshotRecord(snapshot.GetSnapshotId())
+		if err != nil {
+			return nil, nil, err
+		}
+		if record == nil {
+			return nil, nil, status.Errorf(codes.NotFound, "snapshot %s not found", snapshot.GetSnapshotId())
+		}
+		if record.Pending {
+			return nil, nil, status.Errorf(codes.Unavailable, "snapshot %s is not ready yet", snapshot.GetSnapshotId())
+		}
+		secrets, err := getSecretRefData(record.SecretRef)
+		if err != nil {
+			return nil, nil, err
+		}
+		return record.VolumeContext, secrets, nil
+	}
+
+	if volume := contentSource.GetVolume(); volume != nil {
+		pv, err := getPersistentVolume(volume.GetVolumeId())
+		if err != nil {
+			return nil, nil, status.Errorf(codes.Internal, "can not load PV of volume %s: %s", volume.GetVolumeId(), err)
+		}
+		if pv == nil {
+			return nil, nil, status.Errorf(codes.NotFound, "volume %s not found", volume.GetVolumeId())
+		}
+		secrets, err := getSecretRefData(volumeSecretRef(pv))
+		if err != nil {
+			return nil, nil, err
+		}
+		return pv.Spec.CSI.VolumeAttributes, secrets, nil
+	}
+
+	return nil, nil, status.Error(codes.InvalidArgument, "unsupported volume content source")
+}
+
+// Annotations of the external-provisioner keeping the provisioner secret of a volume for deleting it
+const (
+	provisionerDeletionSecretNameAnnotation      = "volume.kubernetes.io/provisioner-deletion-secret-name"
+	provisionerDeletionSecretNamespaceAnnotation = "volume.kubernetes.io/provisioner-deletion-secret-namespace"
+)
+
+// volumeSecretRef returns the secret the controller uses for an existing volume: its provisioner secret,
+// or its nodeStageSecretRef. Volumes without one use rclone-secret.
+func volumeSecretRef(pv *v1.PersistentVolume) *v1.SecretReference {
+	if name := pv.Annotations[provisionerDeletionSecretNameAnnotation]; name != "" {
+		return &v1.SecretReference{Name: name, Namespace: pv.Annotations[provisionerDeletionSecretNamespaceAnnotation]}
+	}
+	if pv.Spec.CSI != nil {
+		return pv.Spec.CSI.NodeStageSecretRef
+	}
+	return nil
+}
+
+// getSecretRefData loads the data of a referenced secret, nil without a reference
+func getSecretRefData(ref *v1.SecretReference) (map[string]string, error) {
+	if ref == nil {
+		return nil, nil
+	}
+
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+	secret, err := clientset.CoreV1().Secrets(ref.Namespace).Get(ref.Name, metav1.GetOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can not load secret %s/%s: %s", ref.Namespace, ref.Name, err)
+	}
+
+	data := map[string]string{}
+	for k, v := range secret.Data {
+		data[k] = string(v)
+	}
+	return data, nil
+}
+
+// volumeCopy is an rclone copy of the content source of a volume
+type volumeCopy struct {
+	configData  string
+	flags       map[string]string
+	source      string
+	destination string
+}
+
+// Config sections of the source and the destination of copies between volumes with different settings
+const (
+	copySourceRemote      = "csi-rclone-source"
+	copyDestinationRemote = "csi-rclone-destination"
+)
+
+// prepareVolumeCopy returns the copy of the source data into the new volume. The source is read with its own
+// volume context and secrets. Copies between volumes with the same settings are server-side on backends
+// supporting it.
+func (cs *controllerServer) prepareVolumeCopy(volumeName string, sourceContext map[string]string, sourceSecrets map[string]string, volumeContext map[string]string, secrets map[string]string) (*volumeCopy, error) {
+	sourceRemote, sourcePath, sourceConfigData, sourceFlags, err := cs.getRemoteFlags(sourceContext, sourceSecrets)
+	if err != nil {
+		return nil, err
+	}
+	remote, remotePath, configData, flags, err := cs.getRemoteFlags(volumeContext, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	// A clone of a volume without a per-volume path would be copied into itself
+	if sourceRemote == remote && strings.HasPrefix(remotePath+"/", strings.TrimSuffix(sourcePath, "/")+"/") {
+		return nil, status.Errorf(codes.InvalidArgument, "volume %s path %s is inside of the source path %s", volumeName, remotePath, sourcePath)
+	}
+
+	// The flags of a copy apply to both remotes, remotes with other settings get their own config section
+	if sourceRemote != remote || sourceConfigData != configData || !reflect.DeepEqual(backendFlags(sourceRemote, sourceFlags), backendFlags(remote, flags)) {
+		globalFlags := map[string]string{}
+		for k, v := range flags {
+			if !isBackendFlag(k, sourceRemote) && !isBackendFlag(k, remote) {
+				globalFlags[k] = v
+			}
+		}
+
+		var sourceSection, section string
+		sourceRemote, sourceSection = copyRemoteSection(copySourceRemote, sourceRemote, sourceConfigData, sourceFlags)
+		remote, section = copyRemoteSection(copyDestinationRemote, remote, configData, flags)
+		if configData, err = mergeConfigData(sourceSection, section); err != nil {
+			return nil, status.Errorf(codes.FailedPrecondition, "can not copy into volume %s: %s", volumeName, err)
+		}
+		flags = globalFlags
+	}
+	source := getRemoteWithPath(sourceRemote, sourcePath, configData)
+
+	// Unencrypted data is encrypted while it is copied into an encrypted volume
+	if volumeContext[encryptionParameter] == encryptionCrypt && sourceContext[encryptionParameter] != encryptionCrypt {
+		password, password2, err := getCryptKeys(volumeContext)
+		if err != nil {
+			return nil, err
+		}
+		if remote, remotePath, configData, err = wrapCryptRemote(remote, remotePath, configData, password, password2); err != nil {
+			return nil, status.Errorf(codes.Internal, "can not configure crypt remote of volume %s: %s", volumeName, err)
+		}
+	}
+
+	return &volumeCopy{
+		configData:  configData,
+		flags:       flags,
+		source:      source,
+		destination: getRemoteWithPath(remote, remotePath, configData),
+	}, nil
+}
+
+// isBackendFlag returns whether flag configures the backend of an on the fly remote (i.e. s3-endpoint of :s3:)
+func isBackendFlag(flag string, remote string) bool {
+	return strings.HasPrefix(normalizeFlagName(flag), remote+"-")
+}
+
+// backendFlags returns the flags configuring the backend of an on the fly remote
+func backendFlags(remote string, flags map[string]string) map[string]string {
+	backend := map[string]string{}
+	for k, v := range flags {
+		if isBackendFlag(k, remote) {
+			backend[k] = v
+		}
+	}
+	return backend
+}
+
+// copyRemoteSection returns the remote of one side of a copy and its config. Remotes of the configData of
+// the volume keep it, on the fly remotes get a config section named name with their backend flags.
+func copyRemoteSection(name string, remote string, configData string, flags map[string]string) (string, string) {
+	if strings.Contains(configData, "["+remote+"]") {
+		return remote, configData
+	}
+
+	options := map[string]string{}
+	names := []string{}
+	for k, v := range backendFlags(remote, flags) {
+		option := strings.ReplaceAll(strings.TrimPrefix(normalizeFlagName(k), remote+"-"), "-", "_")
+		options[option] = v
+		names = append(names, option)
+	}
+	sort.Strings(names)
+
+	section := fmt.Sprintf("[%s]\ntype = %s\n", name, remote)
+	for _, option := range names {
+		section += fmt.Sprintf("%s = %s\n", option, options[option])
+	}
+	return name, section
+}
+
+// Section headers of an rclone config
+var configSectionPattern = regexp.MustCompile(`(?m)^\s*\[([^\]]+)\]`)
+
+// mergeConfigData joins the configs of the source and the destination of a copy, sections of the same
+// name must be the same config
+func mergeConfigData(sourceConfigData string, configData string) (string, error) {
+	if sourceConfigData == configData {
+		return configData, nil
+	}
+
+	names := map[string]bool{}
+	for _, match := range configSectionPattern.FindAllStringSubmatch(sourceConfigData, -1) {
+		names[match[1]] = true
+	}
+	for _, match := range configSectionPattern.FindAllStringSubmatch(configData, -1) {
+		if names[match[1]] {
+			return "", fmt.Errorf("the configData of the source and of the volume both define remote %s", match[1])
+		}
+	}
+
+	return sourceConfigData + "\n" + configData, nil
+}
+
+// createRemotePath creates the volume directory (or bucket) on the remote. Volumes with a templated
+// path must not reuse existing data unless allowExisting is set or the volume is being populated.
+func (cs *controllerServer) createRemotePath(ctx context.Context, volumeName string, volumeContext map[string]string, secrets map[string]string, allowExisting bool) error {
+	remote, remotePath, configData, flags, err := cs.getRemoteFlags(volumeContext, secrets)
+	if err != nil {
+		return err
+	}
+	remoteWithPath := getRemoteWithPath(remote, remotePath, configData)
+
+	// Without a pathPattern all volumes share remotePath, so existing data is expected
+	if !allowExisting && volumeContext["remotePathSuffix"] != "" {
+		out, err := RcloneCommand(ctx, configData, flags, "lsf", "--max-depth=1", remoteWithPath)
+		if err != nil && !isDirNotFound(err) {
+			glog.Errorf("Failed to list %s of volume %s: %v", remoteWithPath, volumeName, err)
+			return status.Errorf(codes.Internal, "failed to list remote path of volume %s: %s", volumeName, err)
+		}
+		// An empty directory is left behind by a retried CreateVolume call
+		if err == nil && strings.TrimSpace(out) != "" {
+			return status.Errorf(codes.AlreadyExists, "remote path %s of volume %s already exists, set allowExisting parameter to reuse it", remoteWithPath, volumeName)
+		}
+	}
+
+	glog.V(4).Infof("Creating %s of volume %s", remoteWithPath, volumeName)
+	if _, err := RcloneCommand(ctx, configData, flags, "mkdir", remoteWithPath); err != nil {
+		glog.Errorf("Failed to create %s of volume %s: %v", remoteWithPath, volumeName, err)
+		return status.Errorf(codes.Internal, "failed to create remote path of volume %s: %s", volumeName, err)
+	}
+
+	return nil
+}
+
+func (cs *controllerServer) DeleteVolume(ctx context.Context, req *csi.DeleteVolumeRequest) (resp *csi.DeleteVolumeResponse, err error) {
+	defer func(start time.Time) { observeOperation("DeleteVolume", start, err) }(time.Now())
+
+	volumeId := req.GetVolumeId()
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteVolume Volume ID must be provided")
+	}
+
+	// A running copy of the content source is stopped first, it would write into the deleted path
+	if cs.cancelOperation(volumeId) {
+		return nil, status.Errorf(codes.Aborted, "populating volume %s is being stopped", volumeId)
+	}
+	if err := deletePopulateRecord(volumeId); err != nil {
+		return nil, err
+	}
+
+	// The remote path is not part of the volume ID, it is recovered from the PV volume attributes
+	pv, err := getPersistentVolume(volumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can not load PV of volume %s: %s", volumeId, err)
+	}
+	if pv == nil {
+		glog.V(4).Infof("No PV found for volume %s, nothing to delete", volumeId)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	volumeContext := pv.Spec.CSI.VolumeAttributes
+	onDelete := volumeContext["onDelete"]
+	if onDelete == "" || onDelete == onDeleteRetain {
+		glog.V(4).Infof("Retaining remote data of volume %s", volumeId)
+		if volumeContext[encryptionKeySecretNameParameter] != "" {
+			if err := retainCryptKeySecret(volumeContext, volumeContext["remotePath"]+volumeContext["remotePathSuffix"]); err != nil {
+				return nil, err
+			}
+		}
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	remotePathSuffix := volumeContext["remotePathSuffix"]
+	if remotePathSuffix == "" {
+		glog.Warningf("Volume %s has no remotePathSuffix, refusing to %s the shared remote path", volumeId, onDelete)
+		return &csi.DeleteVolumeResponse{}, nil
+	}
+
+	remote, remotePath, configData, flags, err := cs.getRemoteFlags(volumeContext, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	remoteWithPath := getRemoteWithPath(remote, remotePath, configData)
+
+	archivePath := ""
+	switch onDelete {
+	case onDeleteDelete:
+		glog.Infof("Purging %s of volume %s", remoteWithPath, volumeId)
+		_, err = RcloneCommand(ctx, configData, flags, "purge", remoteWithPath)
+	case onDeleteArchive:
+		archivePath = fmt.Sprintf("%s/%s/%s%s", strings.TrimSuffix(remotePath, remotePathSuffix), archiveDir, time.Now().UTC().Format("2006-01-02-150405"), remotePathSuffix)
+		archiveWithPath := getRemoteWithPath(remote, archivePath, configData)
+
+		glog.Infof("Archiving %s of volume %s to %s", remoteWithPath, volumeId, archiveWithPath)
+		_, err = RcloneCommand(ctx, configData, flags, "move", remoteWithPath, archiveWithPath, "--delete-empty-src-dirs")
+		if err == nil {
+			// Remove the now empty volume directory, bucket based remotes have nothing to remove
+			if _, e := RcloneCommand(ctx, configData, flags, "rmdir", remoteWithPath); e != nil && !isDirNotFound(e) {
+				glog.Warningf("Cannot remove archived volume directory %s: %v", remoteWithPath, e)
+			}
+		}
+	}
+
+	// Deleting an already deleted volume must succeed
+	if err != nil && !isDirNotFound(err) {
+		glog.Errorf("Failed to %s remote path of volume %s: %v", onDelete, volumeId, err)
+		return nil, status.Errorf(codes.Internal, "failed to %s remote path of volume %s: %s", onDelete, volumeId, err)
+	}
+
+	// Archived data stays readable, the key of purged data is not needed anymore
+	if onDelete == onDeleteArchive && volumeContext[encryptionKeySecretNameParameter] != "" {
+		if err := retainCryptKeySecret(volumeContext, archivePath); err != nil {
+			return nil, err
+		}
+	}
+	if onDelete == onDeleteDelete && volumeContext[encryptionKeySecretNameParameter] != "" {
+		namespace, err := cryptKeySecretNamespace(volumeContext)
+		if err != nil {
+			return nil, err
+		}
+		glog.Infof("Deleting crypt key secret %s/%s of volume %s", namespace, volumeContext[encryptionKeySecretNameParameter], volumeId)
+		if err := deleteCryptKeySecret(volumeContext[encryptionKeySecretNameParameter], namespace); err != nil {
+			return nil, err
+		}
+	}
+
 	return &csi.DeleteVolumeResponse{}, nil
 }
+
+func (cs *controllerServer) ControllerGetVolume(ctx context.Context, req *csi.ControllerGetVolumeRequest) (*csi.ControllerGetVolumeResponse, error) {
+	return nil, status.Error(codes.Unimplemented, "")
+}
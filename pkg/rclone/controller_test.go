@@ -0,0 +1,98 @@
+package rclone
+
+import "testing"
+
+func TestValidateVolumeParameter(t *testing.T) {
+	tests := []struct {
+		key   string
+		valid bool
+	}{
+		{"remote", true},
+		{"remotePath", true},
+		{"configData", true},
+		{"encryption", true},
+		{"tokenAudience", true},
+		{"s3-endpoint", true},
+		{"s3_endpoint", true},
+		{"--vfs-cache-mode", true},
+		{"transfers", true},
+		{"remotePathSuffix", false},
+		{"S3-ENDPOINT", false},
+		{"remotepath ", false},
+		{"s3--endpoint", false},
+		{"-s3-endpoint", false},
+		{"s3-endpoint-", false},
+		{"", false},
+	}
+
+	for _, test := range tests {
+		err := validateVolumeParameter(test.key)
+		if test.valid && err != nil {
+			t.Errorf("validateVolumeParameter(%q) = %v, want nil", test.key, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("validateVolumeParameter(%q) = nil, want error", test.key)
+		}
+	}
+}
+
+func TestCopyRemoteSection(t *testing.T) {
+	tests := []struct {
+		remote      string
+		configData  string
+		flags       map[string]string
+		wantRemote  string
+		wantSection string
+	}{
+		{
+			remote:      "s3",
+			flags:       map[string]string{"s3-provider": "Minio", "S3_ENDPOINT": "http://minio:9000", "s3-access-key-id": "id", "vfs-cache-mode": "full"},
+			wantRemote:  "csi-rclone-source",
+			wantSection: "[csi-rclone-source]\ntype = s3\naccess_key_id = id\nendpoint = http://minio:9000\nprovider = Minio\n",
+		},
+		{
+			remote:      "webdav",
+			flags:       map[string]string{},
+			wantRemote:  "csi-rclone-source",
+			wantSection: "[csi-rclone-source]\ntype = webdav\n",
+		},
+		{
+			remote:      "backup",
+			configData:  "[backup]\ntype = s3\nprovider = AWS\n",
+			flags:       map[string]string{"s3-region": "eu-west-1"},
+			wantRemote:  "backup",
+			wantSection: "[backup]\ntype = s3\nprovider = AWS\n",
+		},
+	}
+
+	for _, test := range tests {
+		remote, section := copyRemoteSection(copySourceRemote, test.remote, test.configData, test.flags)
+		if remote != test.wantRemote || section != test.wantSection {
+			t.Errorf("copyRemoteSection(%q, %q, %v) = %q, %q, want %q, %q", test.remote, test.configData, test.flags, remote, section, test.wantRemote, test.wantSection)
+		}
+	}
+}
+
+func TestMergeConfigData(t *testing.T) {
+	tests := []struct {
+		sourceConfigData string
+		configData       string
+		want             string
+		wantErr          bool
+	}{
+		{"[a]\ntype = s3\n", "[a]\ntype = s3\n", "[a]\ntype = s3\n", false},
+		{"[csi-rclone-source]\ntype = s3\n", "[csi-rclone-destination]\ntype = s3\n", "[csi-rclone-source]\ntype = s3\n\n[csi-rclone-destination]\ntype = s3\n", false},
+		{"[a]\ntype = s3\nregion = eu\n", "[b]\ntype = s3\n\n [a]\ntype = s3\n", "", true},
+	}
+
+	for _, test := range tests {
+		got, err := mergeConfigData(test.sourceConfigData, test.configData)
+		if (err != nil) != test.wantErr {
+			t.Errorf("mergeConfigData(%q, %q) error = %v, want error %v", test.sourceConfigData, test.configData, err, test.wantErr)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("mergeConfigData(%q, %q) = %q, want %q", test.sourceConfigData, test.configData, got, test.want)
+		}
+	}
+}
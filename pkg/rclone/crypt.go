@@ -0,0 +1,281 @@
+package rclone
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Volume context keys of encrypted volumes, they are not rclone flags
+const (
+	encryptionParameter                   = "encryption"
+	encryptionKeySecretNameParameter      = "encryptionKeySecretName"
+	encryptionKeySecretNamespaceParameter = "encryptionKeySecretNamespace"
+)
+
+const (
+	// encryptionCrypt wraps the volume remote in an rclone crypt remote
+	encryptionCrypt = "crypt"
+
+	// Name of the crypt remote added to the generated rclone config
+	cryptRemoteName = "csi-rclone-crypt"
+
+	// Keys of the per-volume key secret, plain (not obscured) crypt password and salt
+	cryptPasswordKey  = "password"
+	cryptPassword2Key = "password2"
+
+	cryptKeySecretPrefix = "csi-rclone-crypt-"
+	cryptKeyLength       = 32
+
+	// Key secrets are labeled with their volume, keys of deleted volumes with retained data are labeled
+	// retained and annotated with the location of the data, they are removed by the admin
+	cryptKeyVolumeLabel     = "csi-rclone/volume"
+	cryptKeyRetainedLabel   = "csi-rclone/retained"
+	cryptKeyRetainedDataKey = "csi-rclone/retained-data"
+	cryptKeyRetainedAtKey   = "csi-rclone/retained-at"
+)
+
+// validateEncryption checks the encryption volume parameter
+func validateEncryption(encryption string) error {
+	if encryption != "" && encryption != encryptionCrypt {
+		return status.Errorf(codes.InvalidArgument, "invalid encryption parameter %q, must be %s", encryption, encryptionCrypt)
+	}
+	return nil
+}
+
+// createCryptKeySecret stores a random password and salt for the volume, or a copy of the source key
+// of restored and cloned data. An existing secret is reused so a retried call does not replace the
+// key of data already written.
+func createCryptKeySecret(volumeName string, namespace string, source *v1.Secret) (*v1.Secret, error) {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+
+	name := cryptKeySecretPrefix + volumeName
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err == nil {
+		glog.V(4).Infof("Reusing crypt key secret %s/%s of volume %s", namespace, name, volumeName)
+		return secret, nil
+	}
+	if !apierrors.IsNotFound(err) {
+		return nil, status.Errorf(codes.Internal, "can not load crypt key secret %s/%s: %s", namespace, name, err)
+	}
+
+	var password, password2 string
+	if source != nil {
+		password = string(source.Data[cryptPasswordKey])
+		password2 = string(source.Data[cryptPassword2Key])
+	} else {
+		if password, err = randomKey(); err != nil {
+			return nil, status.Errorf(codes.Internal, "can not generate crypt password: %s", err)
+		}
+		if password2, err = randomKey(); err != nil {
+			return nil, status.Errorf(codes.Internal, "can not generate crypt salt: %s", err)
+		}
+	}
+
+	secret = &v1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": DriverName,
+				cryptKeyVolumeLabel:            volumeName,
+			},
+			Annotations: map[string]string{
+				cryptKeyVolumeLabel: volumeName,
+			},
+		},
+		Type: v1.SecretTypeOpaque,
+		StringData: map[string]string{
+			cryptPasswordKey:  password,
+			cryptPassword2Key: password2,
+		},
+	}
+
+	glog.Infof("Creating crypt key secret %s/%s of volume %s", namespace, name, volumeName)
+	created, err := clientset.CoreV1().Secrets(namespace).Create(secret)
+	if apierrors.IsAlreadyExists(err) {
+		return clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	}
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can not create crypt key secret %s/%s: %s", namespace, name, err)
+	}
+
+	return created, nil
+}
+
+// deleteCryptKeySecret removes the key of a deleted volume
+func deleteCryptKeySecret(name string, namespace string) error {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+
+	err := clientset.CoreV1().Secrets(namespace).Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return status.Errorf(codes.Internal, "can not delete crypt key secret %s/%s: %s", namespace, name, err)
+	}
+
+	return nil
+}
+
+// retainCryptKeySecret marks the key secret of a deleted volume whose data is kept at dataPath, it is
+// needed to read the data and must be deleted together with it
+func retainCryptKeySecret(volumeContext map[string]string, dataPath string) error {
+	name := volumeContext[encryptionKeySecretNameParameter]
+	namespace, err := cryptKeySecretNamespace(volumeContext)
+	if err != nil {
+		return err
+	}
+
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		glog.Warningf("Crypt key secret %s/%s of retained data %s not found", namespace, name, dataPath)
+		return nil
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "can not load crypt key secret %s/%s: %s", namespace, name, err)
+	}
+
+	if secret.Labels == nil {
+		secret.Labels = map[string]string{}
+	}
+	if secret.Annotations == nil {
+		secret.Annotations = map[string]string{}
+	}
+	secret.Labels[cryptKeyRetainedLabel] = "true"
+	secret.Annotations[cryptKeyRetainedDataKey] = dataPath
+	secret.Annotations[cryptKeyRetainedAtKey] = time.Now().UTC().Format(time.RFC3339)
+
+	glog.Infof("Keeping crypt key secret %s/%s of retained data %s", namespace, name, dataPath)
+	if _, err := clientset.CoreV1().Secrets(namespace).Update(secret); err != nil {
+		return status.Errorf(codes.Internal, "can not update crypt key secret %s/%s: %s", namespace, name, err)
+	}
+
+	return nil
+}
+
+// getCryptKeySecret loads the key secret referenced by the volume context
+func getCryptKeySecret(volumeContext map[string]string) (*v1.Secret, error) {
+	name := volumeContext[encryptionKeySecretNameParameter]
+	if name == "" {
+		return nil, status.Errorf(codes.InvalidArgument, "missing volume context value: %s", encryptionKeySecretNameParameter)
+	}
+	namespace, err := cryptKeySecretNamespace(volumeContext)
+	if err != nil {
+		return nil, err
+	}
+
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+
+	secret, err := clientset.CoreV1().Secrets(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can not load crypt key secret %s/%s: %s", namespace, name, err)
+	}
+
+	if len(secret.Data[cryptPasswordKey]) == 0 {
+		return nil, status.Errorf(codes.InvalidArgument, "crypt key secret %s/%s has no %s", namespace, name, cryptPasswordKey)
+	}
+
+	return secret, nil
+}
+
+// cryptKeySecretNamespace returns the namespace of the key secret, the plugin namespace by default
+func cryptKeySecretNamespace(volumeContext map[string]string) (string, error) {
+	if namespace := volumeContext[encryptionKeySecretNamespaceParameter]; namespace != "" {
+		return namespace, nil
+	}
+	return getDriverNamespace()
+}
+
+// getCryptKeys loads the crypt password and salt referenced by the volume context
+func getCryptKeys(volumeContext map[string]string) (string, string, error) {
+	secret, err := getCryptKeySecret(volumeContext)
+	if err != nil {
+		return "", "", err
+	}
+
+	return string(secret.Data[cryptPasswordKey]), string(secret.Data[cryptPassword2Key]), nil
+}
+
+// wrapCryptRemote adds a crypt remote on top of remote:remotePath to the rclone config
+// and returns it as the remote to mount
+func wrapCryptRemote(remote string, remotePath string, configData string, password string, password2 string) (string, string, string, error) {
+	obscuredPassword, err := obscure(password)
+	if err != nil {
+		return "", "", "", err
+	}
+
+	section := fmt.Sprintf("[%s]\ntype = crypt\nremote = %s\npassword = %s\n",
+		cryptRemoteName, getRemoteWithPath(remote, remotePath, configData), obscuredPassword)
+
+	if password2 != "" {
+		obscuredPassword2, err := obscure(password2)
+		if err != nil {
+			return "", "", "", err
+		}
+		section += fmt.Sprintf("password2 = %s\n", obscuredPassword2)
+	}
+
+	if configData != "" {
+		configData += "\n"
+	}
+
+	return cryptRemoteName, "", configData + section, nil
+}
+
+func randomKey() (string, error) {
+	key := make([]byte, cryptKeyLength)
+	if _, err := io.ReadFull(rand.Reader, key); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(key), nil
+}
+
+// rclone config files store passwords obscured with a fixed key, see https://rclone.org/commands/rclone_obscure/
+var obscureKey = []byte{
+	0x9c, 0x93, 0x5b, 0x48, 0x73, 0x0a, 0x55, 0x4d,
+	0x6b, 0xfd, 0x7c, 0x63, 0xc8, 0x86, 0xa9, 0x2b,
+	0xd3, 0x90, 0x19, 0x8e, 0xb8, 0x12, 0x8a, 0xfb,
+	0xf4, 0xde, 0x16, 0x2b, 0x8b, 0x95, 0xf6, 0x38,
+}
+
+// obscure is the equivalent of rclone obscure
+func obscure(plaintext string) (string, error) {
+	block, err := aes.NewCipher(obscureKey)
+	if err != nil {
+		return "", err
+	}
+
+	ciphertext := make([]byte, aes.BlockSize+len(plaintext))
+	iv := ciphertext[:aes.BlockSize]
+	if _, err := io.ReadFull(rand.Reader, iv); err != nil {
+		return "", err
+	}
+
+	cipher.NewCTR(block, iv).XORKeyStream(ciphertext[aes.BlockSize:], []byte(plaintext))
+
+	return base64.RawURLEncoding.EncodeToString(ciphertext), nil
+}
@@ -0,0 +1,160 @@
+package rclone
+
+import (
+	"fmt"
+	"io/ioutil"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"sigs.k8s.io/yaml"
+)
+
+// Volume context key selecting a profile of the flag profiles file, not an rclone flag
+const flagProfileParameter = "flagProfile"
+
+// DefaultMountFlags are the rclone flags of mounts before --default-flags and flag profiles
+const DefaultMountFlags = "dir-cache-time=5s,vfs-cache-mode=writes,allow-non-empty=true,allow-other=true"
+
+// flagProfiles is the flag profiles file, i.e. a ConfigMap mounted into the nodeplugin:
+//
+//	defaults:
+//	  vfs-cache-mode: full
+//	profiles:
+//	  media-readmostly:
+//	    vfs-read-ahead: 256M
+//	    dir-cache-time: 1h
+type flagProfiles struct {
+	// Defaults override the --default-flags of all mounts
+	Defaults map[string]string `json:"defaults"`
+	// Profiles are selected by the flagProfile StorageClass parameter, they override the defaults
+	Profiles map[string]map[string]string `json:"profiles"`
+}
+
+// defaultFlags holds the rclone flags mounts start with, the lowest layer of extractFlags
+type defaultFlags struct {
+	defaults map[string]string
+	profiles map[string]map[string]string
+}
+
+// parseFlagList parses a comma separated list of <flag>=<value>
+func parseFlagList(list string) (map[string]string, error) {
+	flags := map[string]string{}
+	for _, entry := range strings.Split(list, ",") {
+		entry = strings.TrimSpace(entry)
+		if entry == "" {
+			continue
+		}
+		i := strings.Index(entry, "=")
+		if i <= 0 {
+			return nil, fmt.Errorf("invalid flag %q, must be <flag>=<value>", entry)
+		}
+		flags[strings.TrimPrefix(entry[:i], "--")] = entry[i+1:]
+	}
+	return flags, nil
+}
+
+// loadDefaultFlags merges the --default-flags list with the defaults and profiles of the profiles file
+func loadDefaultFlags(list string, profilesFile string) (*defaultFlags, error) {
+	defaults, err := parseFlagList(list)
+	if err != nil {
+		return nil, err
+	}
+	d := &defaultFlags{defaults: defaults, profiles: map[string]map[string]string{}}
+
+	if profilesFile == "" {
+		return d, nil
+	}
+
+	data, err := ioutil.ReadFile(profilesFile)
+	if err != nil {
+		return nil, err
+	}
+	var file flagProfiles
+	if err := yaml.Unmarshal(data, &file); err != nil {
+		return nil, fmt.Errorf("cannot parse %s: %v", profilesFile, err)
+	}
+
+	for k, v := range file.Defaults {
+		d.defaults[k] = v
+	}
+	for name, flags := range file.Profiles {
+		for k := range flags {
+			if reservedAnnotationFlags[k] {
+				return nil, fmt.Errorf("profile %s sets %q, which is not an rclone flag", name, k)
+			}
+		}
+		d.profiles[name] = flags
+	}
+	glog.Infof("Loaded %d rclone flag profiles from %s", len(d.profiles), profilesFile)
+
+	return d, nil
+}
+
+// forVolume returns the default flags of a volume, with the flags of its profile
+func (d *defaultFlags) forVolume(volumeContext map[string]string) (map[string]string, error) {
+	flags := map[string]string{}
+	for k, v := range d.defaults {
+		flags[k] = v
+	}
+
+	if name := volumeContext[flagProfileParameter]; name != "" {
+		profile, ok := d.profiles[name]
+		if !ok {
+			return nil, status.Errorf(codes.InvalidArgument, "unknown flag profile %q", name)
+		}
+		for k, v := range profile {
+			flags[k] = v
+		}
+	}
+
+	return flags, nil
+}
+
+// Flags holding credentials, their values are not printed whatever layer sets them. Matched after normalizeFlagName.
+var credentialFlagPattern = regexp.MustCompile(`-key|secret|password|token|(^|-)pass[0-9]?($|-)`)
+
+// flagLayer is one source of the flags merged by extractFlags
+type flagLayer struct {
+	name  string
+	flags map[string]string
+	// Values of secrets are not printed, values of credential flags are not printed in any layer
+	secret bool
+}
+
+// describeEffectiveFlags lists the flags of a mount with the layer that set them, for --print-effective-flags.
+// Flags of no layer are set by the nodeplugin (capacity, read-only, ownership, token federation).
+func describeEffectiveFlags(flags map[string]string, layers []flagLayer) string {
+	sources := map[string]flagLayer{}
+	for _, layer := range layers {
+		for k := range layer.flags {
+			sources[k] = layer
+		}
+	}
+
+	keys := make([]string, 0, len(flags))
+	for k := range flags {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	lines := []string{}
+	for _, k := range keys {
+		name, value := "nodeplugin", flags[k]
+		if source, ok := sources[k]; ok && source.flags[k] == value {
+			name = source.name
+			if source.secret {
+				value = "<redacted>"
+			}
+		}
+		if credentialFlagPattern.MatchString(normalizeFlagName(k)) {
+			value = "<redacted>"
+		}
+		lines = append(lines, fmt.Sprintf("  --%s=%s (%s)", k, value, name))
+	}
+
+	return strings.Join(lines, "\n")
+}
@@ -0,0 +1,184 @@
+package rclone
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestParseFlagList(t *testing.T) {
+	tests := []struct {
+		list    string
+		want    map[string]string
+		wantErr bool
+	}{
+		{"", map[string]string{}, false},
+		{DefaultMountFlags, map[string]string{"dir-cache-time": "5s", "vfs-cache-mode": "writes", "allow-non-empty": "true", "allow-other": "true"}, false},
+		{" --vfs-cache-mode=full , ,buffer-size=", map[string]string{"vfs-cache-mode": "full", "buffer-size": ""}, false},
+		{"no-modtime", nil, true},
+		{"=full", nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := parseFlagList(test.list)
+		if (err != nil) != test.wantErr {
+			t.Errorf("parseFlagList(%q) error = %v, want error %v", test.list, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseFlagList(%q) = %v, want %v", test.list, got, test.want)
+		}
+	}
+}
+
+func TestLoadDefaultFlags(t *testing.T) {
+	dir, err := ioutil.TempDir("", "csi-rclone-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFile := func(name string, data string) string {
+		path := filepath.Join(dir, name)
+		if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+
+	valid := writeFile("valid.yaml", "defaults:\n  vfs-cache-mode: full\nprofiles:\n  media:\n    vfs-read-ahead: 256M\n    dir-cache-time: 1h\n")
+	reserved := writeFile("reserved.yaml", "profiles:\n  bad:\n    remotePath: other\n")
+	invalid := writeFile("invalid.yaml", "profiles: [")
+
+	tests := []struct {
+		list         string
+		profilesFile string
+		want         *defaultFlags
+		wantErr      bool
+	}{
+		{"vfs-cache-mode=writes", "", &defaultFlags{defaults: map[string]string{"vfs-cache-mode": "writes"}, profiles: map[string]map[string]string{}}, false},
+		{"vfs-cache-mode=writes,allow-other=true", valid, &defaultFlags{
+			defaults: map[string]string{"vfs-cache-mode": "full", "allow-other": "true"},
+			profiles: map[string]map[string]string{"media": {"vfs-read-ahead": "256M", "dir-cache-time": "1h"}},
+		}, false},
+		{"vfs-cache-mode", "", nil, true},
+		{"", reserved, nil, true},
+		{"", invalid, nil, true},
+		{"", filepath.Join(dir, "missing.yaml"), nil, true},
+	}
+
+	for _, test := range tests {
+		got, err := loadDefaultFlags(test.list, test.profilesFile)
+		if (err != nil) != test.wantErr {
+			t.Errorf("loadDefaultFlags(%q, %q) error = %v, want error %v", test.list, test.profilesFile, err, test.wantErr)
+			continue
+		}
+		if !test.wantErr && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("loadDefaultFlags(%q, %q) = %+v, want %+v", test.list, test.profilesFile, got, test.want)
+		}
+	}
+}
+
+func TestDefaultFlagsForVolume(t *testing.T) {
+	d := &defaultFlags{
+		defaults: map[string]string{"vfs-cache-mode": "writes", "dir-cache-time": "5s"},
+		profiles: map[string]map[string]string{"media": {"dir-cache-time": "1h", "vfs-read-ahead": "256M"}},
+	}
+
+	tests := []struct {
+		volumeContext map[string]string
+		want          map[string]string
+		code          codes.Code
+	}{
+		{nil, map[string]string{"vfs-cache-mode": "writes", "dir-cache-time": "5s"}, codes.OK},
+		{map[string]string{flagProfileParameter: "media"}, map[string]string{"vfs-cache-mode": "writes", "dir-cache-time": "1h", "vfs-read-ahead": "256M"}, codes.OK},
+		{map[string]string{flagProfileParameter: "unknown"}, nil, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		got, err := d.forVolume(test.volumeContext)
+		if code := status.Code(err); code != test.code {
+			t.Errorf("forVolume(%v) = %v, want code %v", test.volumeContext, err, test.code)
+			continue
+		}
+		if test.code == codes.OK && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("forVolume(%v) = %v, want %v", test.volumeContext, got, test.want)
+		}
+	}
+
+	// The defaults are not changed by the profile of a volume
+	if d.defaults["dir-cache-time"] != "5s" {
+		t.Errorf("forVolume changed the defaults: %v", d.defaults)
+	}
+}
+
+func TestDescribeEffectiveFlags(t *testing.T) {
+	flags := map[string]string{
+		"vfs-cache-mode":       "full",
+		"s3-provider":          "AWS",
+		"s3-access-key-id":     "AKIA",
+		"s3-secret-access-key": "from-defaults",
+		"webdav-pass":          "from-volume-context",
+		"S3_SESSION_TOKEN":     "from-mount-options",
+		"sftp-key-pem":         "from-nodeplugin",
+		"crypt-password2":      "salt",
+		"uid":                  "1000",
+	}
+	layers := []flagLayer{
+		{name: "defaults", flags: map[string]string{"vfs-cache-mode": "writes", "s3-secret-access-key": "from-defaults", "crypt-password2": "salt"}},
+		{name: "volume secret", flags: map[string]string{"s3-provider": "AWS", "s3-access-key-id": "AKIA"}, secret: true},
+		{name: "mount options", flags: map[string]string{"vfs-cache-mode": "full", "S3_SESSION_TOKEN": "from-mount-options"}},
+		{name: "volume context", flags: map[string]string{"webdav-pass": "from-volume-context"}},
+	}
+
+	want := strings.Join([]string{
+		"  --S3_SESSION_TOKEN=<redacted> (mount options)",
+		"  --crypt-password2=<redacted> (defaults)",
+		"  --s3-access-key-id=<redacted> (volume secret)",
+		"  --s3-provider=<redacted> (volume secret)",
+		"  --s3-secret-access-key=<redacted> (defaults)",
+		"  --sftp-key-pem=<redacted> (nodeplugin)",
+		"  --uid=1000 (nodeplugin)",
+		"  --vfs-cache-mode=full (mount options)",
+		"  --webdav-pass=<redacted> (volume context)",
+	}, "\n")
+
+	if got := describeEffectiveFlags(flags, layers); got != want {
+		t.Errorf("describeEffectiveFlags() =\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestCredentialFlagPattern(t *testing.T) {
+	tests := []struct {
+		flag string
+		want bool
+	}{
+		{"s3-secret-access-key", true},
+		{"s3-access-key-id", true},
+		{"s3-session-token", true},
+		{"webdav-bearer-token", true},
+		{"sftp-pass", true},
+		{"pass", true},
+		{"crypt-password", true},
+		{"crypt-password2", true},
+		{"azureblob-key", true},
+		{"sftp-key-pem", true},
+		{"vfs-cache-mode", false},
+		{"s3-provider", false},
+		{"passive", false},
+		{"ftp-disable-epsv", false},
+		{"bypass-check", false},
+	}
+
+	for _, test := range tests {
+		if got := credentialFlagPattern.MatchString(normalizeFlagName(test.flag)); got != test.want {
+			t.Errorf("credentialFlagPattern.MatchString(%q) = %v, want %v", test.flag, got, test.want)
+		}
+	}
+}
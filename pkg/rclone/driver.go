@@ -1,14 +1,28 @@
 package rclone
 
 import (
+	"time"
+
 	"github.com/container-storage-interface/spec/lib/go/csi"
 	"github.com/golang/glog"
 	csicommon "github.com/kubernetes-csi/drivers/pkg/csi-common"
+	"golang.org/x/net/context"
 )
 
 type Driver struct {
 	csiDriver *csicommon.CSIDriver
+	nodeID    string
 	endpoint  string
+	stateDir  string
+	nscap     []*csi.NodeServiceCapability
+
+	healthCheckInterval time.Duration
+	quotaCheckInterval  time.Duration
+	allowedAnnotations  string
+	ephemeralRemotes    string
+	defaultFlags        string
+	flagProfiles        string
+	printEffectiveFlags bool
 
 	ns *nodeServer
 	cs *controllerServer
@@ -19,16 +33,47 @@ var (
 	DriverVersion = "latest"
 )
 
-func NewDriver(nodeID, endpoint string) *Driver {
+func NewDriver(nodeID, endpoint, stateDir string, healthCheckInterval, quotaCheckInterval time.Duration, allowedAnnotations string, ephemeralRemotes string, defaultFlags string, flagProfiles string, printEffectiveFlags bool) *Driver {
 	glog.Infof("Starting new %s driver in version %s", DriverName, DriverVersion)
 
 	d := &Driver{}
 
+	d.nodeID = nodeID
 	d.endpoint = endpoint
+	d.stateDir = stateDir
+	d.healthCheckInterval = healthCheckInterval
+	d.quotaCheckInterval = quotaCheckInterval
+	d.allowedAnnotations = allowedAnnotations
+	d.ephemeralRemotes = ephemeralRemotes
+	d.defaultFlags = defaultFlags
+	d.flagProfiles = flagProfiles
+	d.printEffectiveFlags = printEffectiveFlags
 
 	d.csiDriver = csicommon.NewCSIDriver(DriverName, DriverVersion, nodeID)
-	d.csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER})
-	d.csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME})
+	d.csiDriver.AddVolumeCapabilityAccessModes([]csi.VolumeCapability_AccessMode_Mode{
+		csi.VolumeCapability_AccessMode_MULTI_NODE_MULTI_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_MULTI_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_READER_ONLY,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_SINGLE_WRITER,
+		csi.VolumeCapability_AccessMode_SINGLE_NODE_MULTI_WRITER,
+	})
+	d.csiDriver.AddControllerServiceCapabilities([]csi.ControllerServiceCapability_RPC_Type{
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_VOLUME,
+		csi.ControllerServiceCapability_RPC_CREATE_DELETE_SNAPSHOT,
+		csi.ControllerServiceCapability_RPC_LIST_SNAPSHOTS,
+		csi.ControllerServiceCapability_RPC_CLONE_VOLUME,
+		csi.ControllerServiceCapability_RPC_EXPAND_VOLUME,
+	})
+	d.AddNodeServiceCapabilities([]csi.NodeServiceCapability_RPC_Type{
+		csi.NodeServiceCapability_RPC_STAGE_UNSTAGE_VOLUME,
+		csi.NodeServiceCapability_RPC_GET_VOLUME_STATS,
+		csi.NodeServiceCapability_RPC_VOLUME_CONDITION,
+		csi.NodeServiceCapability_RPC_EXPAND_VOLUME,
+		csi.NodeServiceCapability_RPC_SINGLE_NODE_MULTI_WRITER,
+		csi.NodeServiceCapability_RPC_VOLUME_MOUNT_GROUP,
+	})
 
 	d.cs = NewControllerServer(d)
 	d.ns = NewNodeServer(d)
@@ -37,18 +82,66 @@ func NewDriver(nodeID, endpoint string) *Driver {
 }
 
 func NewNodeServer(d *Driver) *nodeServer {
-	return &nodeServer{
+	defaultFlags, err := loadDefaultFlags(d.defaultFlags, d.flagProfiles)
+	if err != nil {
+		glog.Fatalf("Invalid --default-flags or --flag-profiles: %v", err)
+	}
+
+	ns := &nodeServer{
+		Driver:            d,
 		DefaultNodeServer: csicommon.NewDefaultNodeServer(d.csiDriver),
+		mountContext:      map[string]*mountContext{},
+		stateDir:          d.stateDir,
+		ephemeralRemotes:  parseEphemeralRemotes(d.ephemeralRemotes),
+		defaultFlags:      defaultFlags,
 	}
+
+	// Remove credentials left behind by crashed nodeplugins
+	sweepConfigFiles(ns.stateDir)
+
+	// Clean up after the rclone mounts that ended with the previous nodeplugin container
+	ns.cleanupMountStates()
+
+	return ns
+}
+
+// AddNodeServiceCapabilities is the node counterpart of csicommon AddControllerServiceCapabilities
+func (d *Driver) AddNodeServiceCapabilities(nl []csi.NodeServiceCapability_RPC_Type) {
+	var nsc []*csi.NodeServiceCapability
+	for _, n := range nl {
+		glog.Infof("Enabling node service capability: %v", n.String())
+		nsc = append(nsc, &csi.NodeServiceCapability{
+			Type: &csi.NodeServiceCapability_Rpc{
+				Rpc: &csi.NodeServiceCapability_RPC{
+					Type: n,
+				},
+			},
+		})
+	}
+	d.nscap = nsc
 }
 
 func NewControllerServer(d *Driver) *controllerServer {
+	allowedAnnotations, err := parseAllowedAnnotations(d.allowedAnnotations)
+	if err != nil {
+		glog.Fatalf("Invalid --allowed-annotations: %v", err)
+	}
+
 	return &controllerServer{
 		DefaultControllerServer: csicommon.NewDefaultControllerServer(d.csiDriver),
+		allowedAnnotations:      allowedAnnotations,
+		operations:              map[string]context.CancelFunc{},
 	}
 }
 
 func (d *Driver) Run() {
+	if d.healthCheckInterval > 0 {
+		go d.ns.runHealthChecks(d.healthCheckInterval)
+	}
+	if d.quotaCheckInterval > 0 {
+		go d.ns.runQuotaChecks(d.quotaCheckInterval)
+	}
+
 	s := csicommon.NewNonBlockingGRPCServer()
 	s.Start(d.endpoint,
 		csicommon.NewDefaultIdentityServer(d.csiDriver),
@@ -0,0 +1,121 @@
+package rclone
+
+import (
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Volume context key set by kubelet on inline volumes of pod specs
+const ephemeralParameter = "csi.storage.k8s.io/ephemeral"
+
+// Volume context keys inline volumes must not set, they reach data or secrets outside of the pod namespace
+var ephemeralForbiddenParameters = []string{
+	"configData",
+	encryptionParameter,
+	encryptionKeySecretNameParameter,
+	encryptionKeySecretNamespaceParameter,
+}
+
+// rclone flags using files, programs or credentials of the node, i.e. s3-env-auth picks up the node IAM role.
+// Flags of volumes and secrets created by users (inline volumes, pod identity secrets) must not set them.
+// Flag names are matched after normalizeFlagName.
+var nodeCredentialFlagPattern = regexp.MustCompile(`^(config|cache-dir|temp-dir|log-.*|rc|rc-.*|ca-cert|client-cert|client-key|.*env-auth|.*-file|.*-profile|.*-use-msi|.*-msi-.*|.*-use-az|.*-ssh|.*-command|.*-key-use-agent)$`)
+
+// Volume context keys of the driver inline volumes may set, other keys must be rclone flags of their backend
+// or ephemeralAllowedFlags
+var ephemeralAllowedParameters = map[string]bool{
+	"remote":                     true,
+	"remotePath":                 true,
+	flagProfileParameter:         true,
+	capacityParameter:            true,
+	enforceQuotaParameter:        true,
+	tokenAudienceParameter:       true,
+	tokenProviderParameter:       true,
+	awsRoleArnParameter:          true,
+	azureClientIDParameter:       true,
+	azureTenantIDParameter:       true,
+	gcpCredentialConfigParameter: true,
+}
+
+// Backend independent rclone flags inline volumes may set, matched after normalizeFlagName
+var ephemeralAllowedFlagPattern = regexp.MustCompile(`^(read-only|vfs-.*|dir-cache-time|poll-interval|attr-timeout|buffer-size|uid|gid|umask|dir-perms|file-perms|no-modtime|no-checksum|no-seek|use-server-modtime|transfers|checkers|retries|low-level-retries|timeout|contimeout|multi-thread-.*)$`)
+
+// normalizeFlagName returns the flag name rclone reads from a volume key: flags are passed as environment
+// variables, so s3_env_auth, S3-ENV-AUTH and --s3-env-auth all set s3-env-auth
+func normalizeFlagName(key string) string {
+	return strings.ToLower(strings.ReplaceAll(strings.TrimPrefix(key, "--"), "_", "-"))
+}
+
+// isNodeCredentialFlag returns whether key sets a flag using files, programs or credentials of the node
+func isNodeCredentialFlag(key string) bool {
+	return nodeCredentialFlagPattern.MatchString(normalizeFlagName(key))
+}
+
+// isEphemeral returns whether the volume is an inline volume of a pod spec
+func isEphemeral(volumeContext map[string]string) bool {
+	return volumeContext[ephemeralParameter] == "true"
+}
+
+// parseEphemeralRemotes parses the comma separated list of backends inline volumes may use
+func parseEphemeralRemotes(list string) map[string]bool {
+	remotes := map[string]bool{}
+	for _, remote := range strings.Split(list, ",") {
+		if remote = strings.TrimSpace(remote); remote != "" {
+			remotes[remote] = true
+		}
+	}
+	return remotes
+}
+
+// validateEphemeralVolume checks the flags of an inline volume. Inline volumes are created by anyone
+// allowed to create pods, so only allowlisted backends are mounted, with credentials from the
+// nodePublishSecretRef of the pod namespace and without the rclone-secret connection defaults.
+func (ns *nodeServer) validateEphemeralVolume(volumeContext map[string]string, secrets map[string]string) error {
+	if len(ns.ephemeralRemotes) == 0 {
+		return status.Error(codes.PermissionDenied, "inline ephemeral volumes are disabled, no --ephemeral-remotes are configured")
+	}
+
+	for _, key := range ephemeralForbiddenParameters {
+		if _, ok := volumeContext[key]; ok {
+			return status.Errorf(codes.InvalidArgument, "%s can not be set on inline ephemeral volumes", key)
+		}
+		if _, ok := secrets[key]; ok {
+			return status.Errorf(codes.InvalidArgument, "%s can not be set on inline ephemeral volumes", key)
+		}
+	}
+
+	remote := secrets["remote"]
+	if value, ok := volumeContext["remote"]; ok {
+		remote = value
+	}
+	// The remote is a backend name, connection string parameters (":s3,env_auth=true:") are not allowed
+	if !ns.ephemeralRemotes[remote] {
+		return status.Errorf(codes.PermissionDenied, "remote %q is not allowed for inline ephemeral volumes", remote)
+	}
+
+	for _, flags := range []map[string]string{volumeContext, secrets} {
+		for key := range flags {
+			if !isEphemeralFlagAllowed(key, remote) {
+				return status.Errorf(codes.InvalidArgument, "flag %s can not be set on inline ephemeral volumes", key)
+			}
+		}
+	}
+
+	return nil
+}
+
+// isEphemeralFlagAllowed returns whether an inline volume of remote may set key in its volume context or secret
+func isEphemeralFlagAllowed(key string, remote string) bool {
+	if ephemeralAllowedParameters[key] || strings.HasPrefix(key, "csi.storage.k8s.io/") {
+		return true
+	}
+
+	flag := normalizeFlagName(key)
+	if nodeCredentialFlagPattern.MatchString(flag) {
+		return false
+	}
+	return strings.HasPrefix(flag, remote+"-") || ephemeralAllowedFlagPattern.MatchString(flag)
+}
@@ -0,0 +1,142 @@
+package rclone
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestNormalizeFlagName(t *testing.T) {
+	tests := []struct {
+		key  string
+		want string
+	}{
+		{"s3-env-auth", "s3-env-auth"},
+		{"s3_env_auth", "s3-env-auth"},
+		{"S3-ENV-AUTH", "s3-env-auth"},
+		{"--S3_Env_Auth", "s3-env-auth"},
+		{"vfs-cache-mode", "vfs-cache-mode"},
+	}
+
+	for _, test := range tests {
+		if got := normalizeFlagName(test.key); got != test.want {
+			t.Errorf("normalizeFlagName(%q) = %q, want %q", test.key, got, test.want)
+		}
+	}
+}
+
+func TestValidateEphemeralVolume(t *testing.T) {
+	ns := &nodeServer{ephemeralRemotes: parseEphemeralRemotes("s3, webdav")}
+
+	tests := []struct {
+		name          string
+		volumeContext map[string]string
+		secrets       map[string]string
+		want          codes.Code
+	}{
+		{
+			name:          "allowed remote with backend flags",
+			volumeContext: map[string]string{"remote": "s3", "remotePath": "bucket/path", "csi.storage.k8s.io/ephemeral": "true"},
+			secrets:       map[string]string{"s3-provider": "Minio", "s3-access-key-id": "id", "s3-secret-access-key": "key"},
+			want:          codes.OK,
+		},
+		{
+			name:          "remote from the secret",
+			volumeContext: map[string]string{"remotePath": "bucket/path"},
+			secrets:       map[string]string{"remote": "webdav", "webdav-url": "https://example.com"},
+			want:          codes.OK,
+		},
+		{
+			name:          "mount flags",
+			volumeContext: map[string]string{"remote": "s3", "read-only": "true", "vfs-cache-mode": "full", "dir-cache-time": "5m", "UID": "1000"},
+			want:          codes.OK,
+		},
+		{
+			name:          "remote not allowed",
+			volumeContext: map[string]string{"remote": "local"},
+			want:          codes.PermissionDenied,
+		},
+		{
+			name:          "connection string remote",
+			volumeContext: map[string]string{"remote": ":s3,env_auth=true:"},
+			want:          codes.PermissionDenied,
+		},
+		{
+			name:          "configData",
+			volumeContext: map[string]string{"remote": "s3", "configData": "[s3]\ntype = s3"},
+			want:          codes.InvalidArgument,
+		},
+		{
+			name:          "encryption in the secret",
+			volumeContext: map[string]string{"remote": "s3"},
+			secrets:       map[string]string{"encryption": "crypt"},
+			want:          codes.InvalidArgument,
+		},
+		{name: "env auth", volumeContext: map[string]string{"remote": "s3", "s3-env-auth": "true"}, want: codes.InvalidArgument},
+		{name: "env auth with underscores", volumeContext: map[string]string{"remote": "s3", "s3_env_auth": "true"}, want: codes.InvalidArgument},
+		{name: "env auth in upper case", volumeContext: map[string]string{"remote": "s3", "S3-ENV-AUTH": "true"}, want: codes.InvalidArgument},
+		{name: "env auth with dashes prefix", secrets: map[string]string{"remote": "s3", "--s3-env-auth": "true"}, want: codes.InvalidArgument},
+		{name: "cache dir with underscores", volumeContext: map[string]string{"remote": "s3", "cache_dir": "/"}, want: codes.InvalidArgument},
+		{name: "log file with underscores", volumeContext: map[string]string{"remote": "s3", "log_file": "/etc/passwd"}, want: codes.InvalidArgument},
+		{name: "shared credentials file", secrets: map[string]string{"remote": "s3", "s3-shared-credentials-file": "/root/.aws/credentials"}, want: codes.InvalidArgument},
+		{name: "profile", secrets: map[string]string{"remote": "s3", "s3-profile": "node"}, want: codes.InvalidArgument},
+		{name: "managed identity", volumeContext: map[string]string{"remote": "s3", "azureblob-use-msi": "true"}, want: codes.InvalidArgument},
+		{name: "service principal file", volumeContext: map[string]string{"remote": "s3", "azureblob-service-principal-file": "/etc/kubernetes/azure.json"}, want: codes.InvalidArgument},
+		{name: "rc", volumeContext: map[string]string{"remote": "s3", "RC_ADDR": "0.0.0.0:5572"}, want: codes.InvalidArgument},
+		{name: "config", volumeContext: map[string]string{"remote": "s3", "config": "/etc/rclone.conf"}, want: codes.InvalidArgument},
+		{name: "flag of another backend", secrets: map[string]string{"remote": "s3", "sftp-host": "example.com"}, want: codes.InvalidArgument},
+		{name: "unknown global flag", volumeContext: map[string]string{"remote": "s3", "password-command": "cat /etc/shadow"}, want: codes.InvalidArgument},
+		{name: "onDelete", volumeContext: map[string]string{"remote": "s3", "onDelete": "delete"}, want: codes.InvalidArgument},
+		{name: "rclone-secret opt-in", volumeContext: map[string]string{"remote": "s3", "inheritRcloneSecret": "true"}, want: codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		err := ns.validateEphemeralVolume(test.volumeContext, test.secrets)
+		if got := status.Code(err); got != test.want {
+			t.Errorf("%s: validateEphemeralVolume(%v, %v) = %v, want code %v", test.name, test.volumeContext, test.secrets, err, test.want)
+		}
+	}
+}
+
+func TestValidateEphemeralVolumeDisabled(t *testing.T) {
+	ns := &nodeServer{ephemeralRemotes: parseEphemeralRemotes("")}
+
+	err := ns.validateEphemeralVolume(map[string]string{"remote": "s3"}, nil)
+	if status.Code(err) != codes.PermissionDenied {
+		t.Errorf("validateEphemeralVolume without ephemeral remotes = %v, want code %v", err, codes.PermissionDenied)
+	}
+}
+
+func TestIsNodeCredentialFlag(t *testing.T) {
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"s3-access-key-id", false},
+		{"s3-secret-access-key", false},
+		{"azureblob-account", false},
+		{"vfs-cache-mode", false},
+		{"s3-env-auth", true},
+		{"s3_env_auth", true},
+		{"GCS_ENV_AUTH", true},
+		{"gcs-service-account-file", true},
+		{"S3_SHARED_CREDENTIALS_FILE", true},
+		{"s3-profile", true},
+		{"azureblob-use-msi", true},
+		{"azureblob_msi_client_id", true},
+		{"azureblob-service-principal-file", true},
+		{"sftp-key-file", true},
+		{"sftp-ssh", true},
+		{"password-command", true},
+		{"cache_dir", true},
+		{"LOG_FILE", true},
+		{"rc-addr", true},
+	}
+
+	for _, test := range tests {
+		if got := isNodeCredentialFlag(test.key); got != test.want {
+			t.Errorf("isNodeCredentialFlag(%q) = %v, want %v", test.key, got, test.want)
+		}
+	}
+}
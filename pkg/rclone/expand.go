@@ -0,0 +1,83 @@
+package rclone
+
+import (
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+func (cs *controllerServer) ControllerExpandVolume(ctx context.Context, req *csi.ControllerExpandVolumeRequest) (resp *csi.ControllerExpandVolumeResponse, err error) {
+	defer func(start time.Time) { observeOperation("ControllerExpandVolume", start, err) }(time.Now())
+
+	volumeId := req.GetVolumeId()
+	if volumeId == "" {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Volume ID must be provided")
+	}
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+	if capacityBytes <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "ControllerExpandVolume Capacity Range must be provided")
+	}
+
+	pv, err := getPersistentVolume(volumeId)
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can not load PV of volume %s: %s", volumeId, err)
+	}
+	if pv == nil {
+		return nil, status.Errorf(codes.NotFound, "volume %s not found", volumeId)
+	}
+
+	// Nothing is allocated on the remote, the capacity only limits the mounts
+	glog.Infof("Expanding volume %s to %d bytes", volumeId, capacityBytes)
+
+	return &csi.ControllerExpandVolumeResponse{
+		CapacityBytes:         capacityBytes,
+		NodeExpansionRequired: true,
+	}, nil
+}
+
+func (ns *nodeServer) NodeExpandVolume(ctx context.Context, req *csi.NodeExpandVolumeRequest) (resp *csi.NodeExpandVolumeResponse, err error) {
+	defer func(start time.Time) { observeOperation("NodeExpandVolume", start, err) }(time.Now())
+
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Volume Path must be provided")
+	}
+	capacityBytes := req.GetCapacityRange().GetRequiredBytes()
+	if capacityBytes <= 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeExpandVolume Capacity Range must be provided")
+	}
+
+	mc := ns.lookupMountContext(volumePath)
+	if !ns.hasMountContext(mc) && req.GetStagingTargetPath() != "" {
+		mc = ns.getMountContext(req.GetStagingTargetPath())
+	}
+	if !ns.hasMountContext(mc) {
+		return nil, status.Errorf(codes.NotFound, "volume %s is not mounted at %s", req.GetVolumeId(), volumePath)
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if capacityBytes > mc.CapacityBytes {
+		glog.Infof("Expanding volume %s at %s from %d to %d bytes", mc.VolumeID, mc.TargetPath, mc.CapacityBytes, capacityBytes)
+
+		// rclone can not change the cache and disk size of a running VFS, and a remount would break the mounts
+		// of the running pods. The next mount of the volume (a remount of a broken mount, a restage) gets the
+		// new sizes, the quota checks use the new capacity right away.
+		updateCapacityFlags(mc.params.flags, mc.CapacityBytes, capacityBytes)
+		mc.CapacityBytes = capacityBytes
+		ns.setMountContext(mc.TargetPath, mc)
+
+		ns.recordMountEvent(mc, v1.EventTypeNormal, "VolumeExpanded",
+			"volume quota has been expanded, the size reported by df changes when the volume is mounted again")
+	}
+
+	return &csi.NodeExpandVolumeResponse{
+		CapacityBytes: capacityBytes,
+	}, nil
+}
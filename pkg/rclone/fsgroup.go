@@ -0,0 +1,71 @@
+package rclone
+
+import (
+	"strconv"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// umask of mounts owned by the pod fsGroup, the group members can write
+const mountGroupUmask = "002"
+
+// mountOwnership returns the uid and gid of the pod security context the mount should be owned by.
+// The gid is the fsGroup kubelet passes as volume mount group, pods of unstaged mounts (inline volumes)
+// are looked up for the runAsUser and, on clusters not passing the volume mount group, the fsGroup.
+func mountOwnership(capability *csi.VolumeCapability, volumeContext map[string]string) (string, string) {
+	uid := ""
+	gid := capability.GetMount().GetVolumeMountGroup()
+
+	podName := volumeContext["csi.storage.k8s.io/pod.name"]
+	podNamespace := volumeContext["csi.storage.k8s.io/pod.namespace"]
+	if podName == "" || podNamespace == "" {
+		return uid, gid
+	}
+
+	clientset, e := GetK8sClient()
+	if e != nil {
+		glog.Warningf("can not create kubernetes client: %s", e)
+		return uid, gid
+	}
+	pod, err := clientset.CoreV1().Pods(podNamespace).Get(podName, metav1.GetOptions{})
+	if err != nil {
+		glog.Warningf("Cannot load pod %s/%s for its security context: %v", podNamespace, podName, err)
+		return uid, gid
+	}
+
+	if securityContext := pod.Spec.SecurityContext; securityContext != nil {
+		if securityContext.RunAsUser != nil {
+			uid = strconv.FormatInt(*securityContext.RunAsUser, 10)
+		}
+		if gid == "" && securityContext.FSGroup != nil {
+			gid = strconv.FormatInt(*securityContext.FSGroup, 10)
+		}
+	}
+
+	return uid, gid
+}
+
+// applyOwnershipFlags sets the rclone uid, gid and umask flags of the pod security context, unless
+// they are set by the volume context or the mount options. The connection defaults are overridden.
+func applyOwnershipFlags(flags map[string]string, explicit []map[string]string, uid string, gid string) {
+	isExplicit := func(flag string) bool {
+		for _, values := range explicit {
+			if _, ok := values[flag]; ok {
+				return true
+			}
+		}
+		return false
+	}
+
+	if uid != "" && !isExplicit("uid") {
+		flags["uid"] = uid
+	}
+	if gid != "" && !isExplicit("gid") {
+		flags["gid"] = gid
+		if !isExplicit("umask") {
+			flags["umask"] = mountGroupUmask
+		}
+	}
+}
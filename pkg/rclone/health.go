@@ -0,0 +1,210 @@
+package rclone
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/kubernetes/pkg/util/mount"
+)
+
+// mountCheckTimeout bounds the mountpoint check, a hung rclone process blocks readdir forever
+const mountCheckTimeout = 10 * time.Second
+
+// runHealthChecks periodically checks all mounts and remounts broken ones
+func (ns *nodeServer) runHealthChecks(interval time.Duration) {
+	glog.Infof("Checking rclone mounts every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, mc := range ns.listMountContexts() {
+			// Checks run concurrently, NodeUnpublishVolume may hold a mount for up to an hour while draining uploads
+			if !atomic.CompareAndSwapInt32(&mc.checking, 0, 1) {
+				continue
+			}
+			go func(mc *mountContext) {
+				defer atomic.StoreInt32(&mc.checking, 0)
+				ns.checkMount(mc)
+			}(mc)
+		}
+	}
+}
+
+// checkMount remounts a mount whose rclone process or mountpoint is broken
+func (ns *nodeServer) checkMount(mc *mountContext) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	// The volume got unpublished or republished while waiting for the lock
+	if !ns.hasMountContext(mc) {
+		return
+	}
+
+	// The supervisor restarts crashed rclone processes by itself
+	if mc.process != nil && mc.process.isRestarting() {
+		return
+	}
+
+	healthErr := checkMountHealth(mc)
+	if healthErr == nil {
+		return
+	}
+	glog.Warningf("rclone mount of volume %s at %s is broken: %v", mc.VolumeID, mc.TargetPath, healthErr)
+
+	if err := ns.remount(mc); err != nil {
+		glog.Errorf("Remounting volume %s at %s failed: %v", mc.VolumeID, mc.TargetPath, err)
+		ns.recordMountEvent(mc, v1.EventTypeWarning, "RemountFailed",
+			fmt.Sprintf("rclone mount of volume %s is broken (%v), remount failed: %v", mc.VolumeID, healthErr, err))
+		return
+	}
+
+	// Persist the new rc address
+	ns.setMountContext(mc.TargetPath, mc)
+
+	glog.Infof("Remounted volume %s at %s", mc.VolumeID, mc.TargetPath)
+	ns.recordMountEvent(mc, v1.EventTypeNormal, "Remounted",
+		fmt.Sprintf("rclone mount of volume %s was broken (%v) and has been remounted", mc.VolumeID, healthErr))
+
+	ns.rebindPublishPaths(mc)
+}
+
+// rebindRestartedMount rebinds the pod target paths of a mount whose rclone process was restarted by the supervisor
+func (ns *nodeServer) rebindRestartedMount(mc *mountContext, process *rcloneProcess) {
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	// The mount got unpublished or remounted meanwhile
+	if !ns.hasMountContext(mc) || mc.process != process {
+		return
+	}
+
+	ns.rebindPublishPaths(mc)
+}
+
+// rebindPublishPaths bind mounts a remounted staging path into the pod target paths again, the old bind
+// mounts point to the superblock of the dead rclone mount. Bind mounts keep their read-only flag.
+// The caller holds mc.mu.
+func (ns *nodeServer) rebindPublishPaths(mc *mountContext) {
+	if len(mc.PublishPaths) == 0 {
+		return
+	}
+
+	// The old bind mounts are still listed with their options
+	mountOptions, err := getMountOptions()
+	if err != nil {
+		glog.Warningf("Cannot read mount options of the bind mounts of volume %s: %v", mc.VolumeID, err)
+	}
+
+	m := mount.New("")
+	failed := []string{}
+	for _, publishPath := range mc.PublishPaths {
+		options := []string{"bind"}
+		for _, option := range mountOptions[publishPath] {
+			if option == "ro" {
+				options = append(options, "ro")
+			}
+		}
+
+		lazyUnmount(publishPath)
+		if err := m.Mount(mc.TargetPath, publishPath, "", options); err != nil {
+			glog.Errorf("Cannot bind mount %s to %s: %v", mc.TargetPath, publishPath, err)
+			failed = append(failed, publishPath)
+			continue
+		}
+		glog.V(4).Infof("Bind mounted remounted volume %s to %s", mc.VolumeID, publishPath)
+	}
+
+	if len(failed) > 0 {
+		ns.recordMountEvent(mc, v1.EventTypeWarning, "RemountFailed",
+			fmt.Sprintf("rclone mount of volume %s has been remounted, but can not be bind mounted to %s", mc.VolumeID, strings.Join(failed, ", ")))
+	}
+}
+
+// checkMountHealth verifies that the rclone process responds and the mountpoint is readable
+func checkMountHealth(mc *mountContext) error {
+	if mc.RcAddr == "" {
+		return fmt.Errorf("no rclone process is tracked")
+	}
+
+	if _, err := getRclonePID(mc.RcAddr); err != nil {
+		return fmt.Errorf("rclone rc endpoint does not respond: %v", err)
+	}
+
+	if err := probeMount(mc.TargetPath, "health", func() error { return checkMountpoint(mc.TargetPath) }); err != nil {
+		return fmt.Errorf("mountpoint is not readable: %v", err)
+	}
+
+	return nil
+}
+
+// Probes of mountpoints that did not return yet, by path and probe name
+var pendingProbes sync.Map
+
+// probeMount runs probe, a syscall on the mountpoint at path, with mountCheckTimeout. The syscall of a hung
+// FUSE mount blocks in the kernel forever, the probe is not started again while the previous one is blocked.
+func probeMount(path string, name string, probe func() error) error {
+	key := name + ":" + path
+	if _, pending := pendingProbes.LoadOrStore(key, true); pending {
+		return fmt.Errorf("mountpoint did not respond to the previous %s check", name)
+	}
+
+	result := make(chan error, 1)
+	go func() {
+		defer pendingProbes.Delete(key)
+		result <- probe()
+	}()
+
+	select {
+	case err := <-result:
+		return err
+	case <-time.After(mountCheckTimeout):
+		return fmt.Errorf("mountpoint did not respond within %s", mountCheckTimeout)
+	}
+}
+
+// remount stops what is left of the rclone process and mounts the volume again
+func (ns *nodeServer) remount(mc *mountContext) error {
+	if mc.process != nil {
+		glog.V(4).Infof("Stopping rclone process %d of volume %s", mc.process.pid(), mc.VolumeID)
+		mc.process.Stop()
+	}
+
+	lazyUnmount(mc.TargetPath)
+
+	return ns.mount(mc)
+}
+
+// recordMountEvent records an event on the pod using the mount, or on its PersistentVolume
+func (ns *nodeServer) recordMountEvent(mc *mountContext, eventType string, reason string, message string) {
+	var ref *v1.ObjectReference
+	if mc.PodName != "" {
+		ref = &v1.ObjectReference{
+			Kind:       "Pod",
+			APIVersion: "v1",
+			Name:       mc.PodName,
+			Namespace:  mc.PodNamespace,
+			UID:        types.UID(mc.PodUID),
+		}
+	} else {
+		pv, err := getPersistentVolume(mc.VolumeID)
+		if err != nil || pv == nil {
+			glog.V(4).Infof("No PV found for volume %s, not recording event %s", mc.VolumeID, reason)
+			return
+		}
+		ref = &v1.ObjectReference{
+			Kind:       "PersistentVolume",
+			APIVersion: "v1",
+			Name:       pv.Name,
+			UID:        pv.UID,
+		}
+	}
+
+	recordEvent(ref, ns.Driver.nodeID, eventType, reason, message)
+}
@@ -1,6 +1,12 @@
 package rclone
 
 import (
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 )
@@ -23,3 +29,79 @@ func GetK8sClient() (*kubernetes.Clientset, error) {
 	}
 	return clientset, nil
 }
+
+// getPersistentVolume looks up the PersistentVolume of this driver with the given volume handle
+func getPersistentVolume(volumeId string) (*v1.PersistentVolume, error) {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+
+	// Dynamically provisioned volumes are named after their volume ID, static PVs are looked up by their handle
+	pv, err := clientset.CoreV1().PersistentVolumes().Get(volumeId, metav1.GetOptions{})
+	if err == nil && isVolumeOf(pv, volumeId) {
+		return pv, nil
+	}
+	if err != nil && !apierrors.IsNotFound(err) {
+		glog.Errorf("Failed to get PV %s: %v", volumeId, err)
+		return nil, err
+	}
+
+	pvs, err := clientset.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		glog.Errorf("Failed to list PVs: %v", err)
+		return nil, err
+	}
+
+	for i := range pvs.Items {
+		if isVolumeOf(&pvs.Items[i], volumeId) {
+			return &pvs.Items[i], nil
+		}
+	}
+
+	return nil, nil
+}
+
+// isVolumeOf returns whether the PersistentVolume is the volume of this driver with the given volume handle
+func isVolumeOf(pv *v1.PersistentVolume, volumeId string) bool {
+	csiSource := pv.Spec.CSI
+	return csiSource != nil && csiSource.Driver == DriverName && csiSource.VolumeHandle == volumeId
+}
+
+// recordEvent creates a Kubernetes event for the object, failures are only logged
+func recordEvent(ref *v1.ObjectReference, host string, eventType string, reason string, message string) {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		glog.Warningf("can not create kubernetes client: %s", e)
+		return
+	}
+
+	// Events of cluster scoped objects (PersistentVolumes) go to the default namespace
+	namespace := ref.Namespace
+	if namespace == "" {
+		namespace = metav1.NamespaceDefault
+	}
+
+	now := metav1.Now()
+	event := &v1.Event{
+		ObjectMeta: metav1.ObjectMeta{
+			GenerateName: ref.Name + ".",
+			Namespace:    namespace,
+		},
+		InvolvedObject: *ref,
+		Reason:         reason,
+		Message:        message,
+		Type:           eventType,
+		FirstTimestamp: now,
+		LastTimestamp:  now,
+		Count:          1,
+		Source: v1.EventSource{
+			Component: DriverName,
+			Host:      host,
+		},
+	}
+
+	if _, err := clientset.CoreV1().Events(namespace).Create(event); err != nil {
+		glog.Warningf("Failed to record event %s for %s %s/%s: %v", reason, ref.Kind, ref.Namespace, ref.Name, err)
+	}
+}
@@ -0,0 +1,174 @@
+package rclone
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"google.golang.org/grpc/status"
+)
+
+const metricsNamespace = "csi_rclone"
+
+// metricsRcTimeout bounds the rc calls of a scrape, all mounts together must stay below the Prometheus scrape timeout
+const metricsRcTimeout = 2 * time.Second
+
+var (
+	operationsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "operations_total",
+		Help:      "Number of CSI calls by method and gRPC status code.",
+	}, []string{"method", "code"})
+
+	operationDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "operation_duration_seconds",
+		Help:      "Duration of CSI calls by method.",
+		Buckets:   []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600},
+	}, []string{"method"})
+
+	mountFailuresTotal = prometheus.NewCounter(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "mount_failures_total",
+		Help:      "Number of failed rclone mount attempts.",
+	})
+
+	unpublishDrainDuration = prometheus.NewHistogram(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "unpublish_drain_duration_seconds",
+		Help:      "Time spent waiting for VFS uploads to finish before unmounting.",
+		Buckets:   []float64{1, 5, 10, 30, 60, 300, 900, 1800, 3600},
+	})
+)
+
+// observeOperation records the outcome and duration of a CSI call
+func observeOperation(method string, start time.Time, err error) {
+	operationsTotal.WithLabelValues(method, status.Code(err).String()).Inc()
+	operationDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+var (
+	volumeLabels = []string{"volume_id", "target_path"}
+
+	mountsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "", "mounts"),
+		"Number of rclone mounts managed by the nodeplugin.",
+		nil, nil)
+	volumeUpDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "up"),
+		"Whether the rclone rc server of the mount responds.",
+		volumeLabels, nil)
+	volumeTransferredBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "transferred_bytes_total"),
+		"Bytes transferred by the rclone mount.",
+		volumeLabels, nil)
+	volumeTransfersDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "transfers_total"),
+		"Completed transfers of the rclone mount.",
+		volumeLabels, nil)
+	volumeErrorsDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "errors_total"),
+		"Errors reported by the rclone mount.",
+		volumeLabels, nil)
+	volumeUploadsQueuedDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "uploads_queued"),
+		"VFS cache uploads waiting to start.",
+		volumeLabels, nil)
+	volumeUploadsInProgressDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "uploads_in_progress"),
+		"VFS cache uploads in progress.",
+		volumeLabels, nil)
+	volumeCacheBytesDesc = prometheus.NewDesc(
+		prometheus.BuildFQName(metricsNamespace, "volume", "cache_bytes"),
+		"Disk space used by the VFS cache.",
+		volumeLabels, nil)
+)
+
+// volumeCollector scrapes the rc server of every mount on each collection
+type volumeCollector struct {
+	ns *nodeServer
+}
+
+func (c *volumeCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- mountsDesc
+	ch <- volumeUpDesc
+	ch <- volumeTransferredBytesDesc
+	ch <- volumeTransfersDesc
+	ch <- volumeErrorsDesc
+	ch <- volumeUploadsQueuedDesc
+	ch <- volumeUploadsInProgressDesc
+	ch <- volumeCacheBytesDesc
+}
+
+func (c *volumeCollector) Collect(ch chan<- prometheus.Metric) {
+	mountContexts := c.ns.listMountContexts()
+
+	ch <- prometheus.MustNewConstMetric(mountsDesc, prometheus.GaugeValue, float64(len(mountContexts)))
+
+	// A hung rclone process must not hold up the metrics of the other mounts
+	var wg sync.WaitGroup
+	for _, mc := range mountContexts {
+		if mc.RcAddr == "" {
+			continue
+		}
+		wg.Add(1)
+		go func(mc *mountContext) {
+			defer wg.Done()
+			c.collectMount(ch, mc)
+		}(mc)
+	}
+	wg.Wait()
+}
+
+// collectMount scrapes the rc server of one mount
+func (c *volumeCollector) collectMount(ch chan<- prometheus.Metric, mc *mountContext) {
+	labels := []string{mc.VolumeID, mc.TargetPath}
+
+	var coreStats rcCoreStatsResponse
+	out, err := rcloneRPCWithTimeout(mc.RcAddr, "core/stats", "{}", metricsRcTimeout)
+	if err == nil {
+		err = json.Unmarshal([]byte(out), &coreStats)
+	}
+	if err != nil {
+		glog.V(4).Infof("cannot collect core/stats of %s: %v", mc.TargetPath, err)
+		ch <- prometheus.MustNewConstMetric(volumeUpDesc, prometheus.GaugeValue, 0, labels...)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(volumeUpDesc, prometheus.GaugeValue, 1, labels...)
+	ch <- prometheus.MustNewConstMetric(volumeTransferredBytesDesc, prometheus.CounterValue, float64(coreStats.Bytes), labels...)
+	ch <- prometheus.MustNewConstMetric(volumeTransfersDesc, prometheus.CounterValue, float64(coreStats.Transfers), labels...)
+	ch <- prometheus.MustNewConstMetric(volumeErrorsDesc, prometheus.CounterValue, float64(coreStats.Errors), labels...)
+
+	var vfsStats rcVfsStatsResponse
+	out, err = rcloneRPCWithTimeout(mc.RcAddr, "vfs/stats", "{}", metricsRcTimeout)
+	if err == nil {
+		err = json.Unmarshal([]byte(out), &vfsStats)
+	}
+	if err != nil {
+		glog.V(4).Infof("cannot collect vfs/stats of %s: %v", mc.TargetPath, err)
+		return
+	}
+	ch <- prometheus.MustNewConstMetric(volumeUploadsQueuedDesc, prometheus.GaugeValue, float64(vfsStats.DiskCache.UploadsQueued), labels...)
+	ch <- prometheus.MustNewConstMetric(volumeUploadsInProgressDesc, prometheus.GaugeValue, float64(vfsStats.DiskCache.UploadsInProgress), labels...)
+	ch <- prometheus.MustNewConstMetric(volumeCacheBytesDesc, prometheus.GaugeValue, float64(vfsStats.DiskCache.BytesUsed), labels...)
+}
+
+// ServeMetrics registers the driver metrics and serves them on address/metrics
+func (d *Driver) ServeMetrics(address string) {
+	prometheus.MustRegister(operationsTotal, operationDuration, mountFailuresTotal, unpublishDrainDuration)
+	prometheus.MustRegister(&volumeCollector{ns: d.ns})
+
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	go func() {
+		glog.Infof("Serving metrics on %s/metrics", address)
+		if err := http.ListenAndServe(address, mux); err != nil {
+			glog.Errorf("Metrics server failed: %v", err)
+		}
+	}()
+}
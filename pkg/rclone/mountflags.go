@@ -0,0 +1,104 @@
+package rclone
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Mount options without value and the rclone flags they translate to
+var mountOptionFlags = map[string][2]string{
+	"ro":                  {"read-only", "true"},
+	"allow_other":         {"allow-other", "true"},
+	"allow_root":          {"allow-root", "true"},
+	"default_permissions": {"default-permissions", "true"},
+}
+
+// Mount options with value and the rclone flags they translate to, with the validator of the value
+var mountOptionValueFlags = map[string]struct {
+	flag      string
+	validator flagValidator
+}{
+	"uid":       {"uid", intRangeValidator(0, 1<<32-1, 10)},
+	"gid":       {"gid", intRangeValidator(0, 1<<32-1, 10)},
+	"umask":     {"umask", intRangeValidator(0, 0777, 8)},
+	"dir_mode":  {"dir-perms", intRangeValidator(0, 0777, 8)},
+	"file_mode": {"file-perms", intRangeValidator(0, 0777, 8)},
+}
+
+// Mount options passed to FUSE with rclone --option
+var fuseMountOptions = map[string]bool{
+	"noexec":  true,
+	"nosuid":  true,
+	"nodev":   true,
+	"noatime": true,
+}
+
+// Mount options that are the rclone defaults
+var ignoredMountOptions = map[string]bool{
+	"rw":       true,
+	"defaults": true,
+}
+
+// translateMountFlags converts the mountOptions of the PersistentVolume (StorageClass mountOptions)
+// to rclone flags. Standard mount options (ro, uid=, gid=, allow_other, noexec, dir_mode=, file_mode=)
+// are translated, options with a "-" are rclone flags (vfs-cache-mode=full, --no-modtime).
+func translateMountFlags(mountFlags []string) (map[string]string, error) {
+	flags := map[string]string{}
+	fuseOptions := []string{}
+
+	for _, mountFlag := range mountFlags {
+		// kubelet passes the options as given, "ro,uid=1000" is one entry
+		for _, option := range strings.Split(mountFlag, ",") {
+			option = strings.TrimSpace(option)
+			if option == "" || ignoredMountOptions[option] {
+				continue
+			}
+
+			key, value, hasValue := option, "", false
+			if i := strings.Index(option, "="); i >= 0 {
+				key, value, hasValue = option[:i], option[i+1:], true
+			}
+
+			if flag, ok := mountOptionFlags[key]; ok && !hasValue {
+				flags[flag[0]] = flag[1]
+				continue
+			}
+			if fuseMountOptions[key] && !hasValue {
+				fuseOptions = append(fuseOptions, key)
+				continue
+			}
+			if mapping, ok := mountOptionValueFlags[key]; ok && hasValue {
+				if err := mapping.validator(value); err != nil {
+					return nil, status.Errorf(codes.InvalidArgument, "invalid value %q of mount option %s: %s", value, key, err)
+				}
+				flags[mapping.flag] = value
+				continue
+			}
+
+			// rclone flags, the "--" prefix is optional. Flags without value are told apart from
+			// mount options rclone has no equivalent for (i.e. sync) by their "-". Those were ignored
+			// by earlier versions, volumes using them still mount.
+			flag := strings.TrimPrefix(key, "--")
+			if !hasValue && !strings.Contains(flag, "-") {
+				glog.Warningf("Ignoring unsupported mount option %q, rclone flags are passed as <flag>=<value>", option)
+				continue
+			}
+			if reservedAnnotationFlags[flag] || strings.HasPrefix(flag, "csi.storage.k8s.io/") {
+				return nil, status.Errorf(codes.InvalidArgument, "%q is not an rclone flag and can not be set with mount options", flag)
+			}
+			if !hasValue {
+				value = "true"
+			}
+			flags[flag] = value
+		}
+	}
+
+	if len(fuseOptions) > 0 {
+		flags["option"] = strings.Join(fuseOptions, ",")
+	}
+
+	return flags, nil
+}
@@ -0,0 +1,48 @@
+package rclone
+
+import (
+	"reflect"
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func TestTranslateMountFlags(t *testing.T) {
+	tests := []struct {
+		mountFlags []string
+		want       map[string]string
+		code       codes.Code
+	}{
+		{nil, map[string]string{}, codes.OK},
+		{[]string{"ro"}, map[string]string{"read-only": "true"}, codes.OK},
+		{[]string{"ro,uid=1000", "gid=2000"}, map[string]string{"read-only": "true", "uid": "1000", "gid": "2000"}, codes.OK},
+		{[]string{"allow_other", "allow_root", "default_permissions"}, map[string]string{"allow-other": "true", "allow-root": "true", "default-permissions": "true"}, codes.OK},
+		{[]string{"umask=022", "dir_mode=0770", "file_mode=0660"}, map[string]string{"umask": "022", "dir-perms": "0770", "file-perms": "0660"}, codes.OK},
+		{[]string{"noexec", "nosuid,nodev"}, map[string]string{"option": "noexec,nosuid,nodev"}, codes.OK},
+		{[]string{"rw", "defaults", " "}, map[string]string{}, codes.OK},
+		{[]string{"vfs-cache-mode=full", "--no-modtime", "--dir-cache-time=5m"}, map[string]string{"vfs-cache-mode": "full", "no-modtime": "true", "dir-cache-time": "5m"}, codes.OK},
+		{[]string{"timeout=1m"}, map[string]string{"timeout": "1m"}, codes.OK},
+		// Mount options rclone has no equivalent for are ignored
+		{[]string{"sync", "ro"}, map[string]string{"read-only": "true"}, codes.OK},
+		{[]string{"relatime,_netdev"}, map[string]string{}, codes.OK},
+		{[]string{"uid=-1"}, nil, codes.InvalidArgument},
+		{[]string{"uid=abc"}, nil, codes.InvalidArgument},
+		{[]string{"umask=999"}, nil, codes.InvalidArgument},
+		{[]string{"dir_mode=01777"}, nil, codes.InvalidArgument},
+		{[]string{"remote=other"}, nil, codes.InvalidArgument},
+		{[]string{"--configData=x"}, nil, codes.InvalidArgument},
+		{[]string{"csi.storage.k8s.io/ephemeral=true"}, nil, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		got, err := translateMountFlags(test.mountFlags)
+		if code := status.Code(err); code != test.code {
+			t.Errorf("translateMountFlags(%q) = %v, want code %v", test.mountFlags, err, test.code)
+			continue
+		}
+		if test.code == codes.OK && !reflect.DeepEqual(got, test.want) {
+			t.Errorf("translateMountFlags(%q) = %v, want %v", test.mountFlags, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,181 @@
+package rclone
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/golang/glog"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Mount contexts are persisted as one JSON file per target path in the state directory, a restarted
+// nodeplugin finds the mounts that ended with its previous container in it.
+
+// https://rclone.org/rc/#core-pid
+type rcCorePidResponse struct {
+	Pid int `json:"pid"`
+}
+
+// mountID derives a file name safe identifier from the target path of a mount
+func mountID(targetPath string) string {
+	return fmt.Sprintf("%x", sha256.Sum256([]byte(targetPath)))
+}
+
+func mountStateFile(stateDir string, targetPath string) string {
+	return filepath.Join(stateDir, mountID(targetPath)+".json")
+}
+
+// saveMountState writes the mount context to the state directory
+func saveMountState(stateDir string, mc *mountContext) error {
+	if err := os.MkdirAll(stateDir, 0700); err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(mc)
+	if err != nil {
+		return err
+	}
+
+	// Write to a temporary file first so a crash never leaves a truncated state file behind
+	stateFile := mountStateFile(stateDir, mc.TargetPath)
+	if err := ioutil.WriteFile(stateFile+".tmp", data, 0600); err != nil {
+		return err
+	}
+	return os.Rename(stateFile+".tmp", stateFile)
+}
+
+// removeMountState deletes the persisted mount context of a target path
+func removeMountState(stateDir string, targetPath string) error {
+	err := os.Remove(mountStateFile(stateDir, targetPath))
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return nil
+}
+
+// loadMountStates reads all persisted mount contexts from the state directory
+func loadMountStates(stateDir string) ([]*mountContext, error) {
+	files, err := filepath.Glob(filepath.Join(stateDir, "*.json"))
+	if err != nil {
+		return nil, err
+	}
+
+	mountContexts := []*mountContext{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			glog.Warningf("cannot read mount state %s: %v", file, err)
+			continue
+		}
+
+		var mc mountContext
+		if err := json.Unmarshal(data, &mc); err != nil || mc.TargetPath == "" {
+			glog.Warningf("removing invalid mount state %s: %v", file, err)
+			os.Remove(file)
+			continue
+		}
+		mountContexts = append(mountContexts, &mc)
+	}
+
+	return mountContexts, nil
+}
+
+// getMountPoints parses /proc/self/mountinfo and returns the set of current mount points
+func getMountPoints() (map[string]bool, error) {
+	mountOptions, err := getMountOptions()
+	if err != nil {
+		return nil, err
+	}
+
+	mountPoints := map[string]bool{}
+	for mountPoint := range mountOptions {
+		mountPoints[mountPoint] = true
+	}
+
+	return mountPoints, nil
+}
+
+// getMountOptions returns the per-mount options (ro, nosuid, ...) of every mount point, the options of
+// the topmost mount when mounts are stacked
+func getMountOptions() (map[string][]string, error) {
+	file, err := os.Open("/proc/self/mountinfo")
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	mountOptions := map[string][]string{}
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		// 36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+		fields := strings.Fields(scanner.Text())
+		if len(fields) < 6 {
+			continue
+		}
+		mountOptions[unescapeMountInfo(fields[4])] = strings.Split(fields[5], ",")
+	}
+
+	return mountOptions, scanner.Err()
+}
+
+// unescapeMountInfo decodes octal escapes (\040 for space, etc.) used in mountinfo paths
+func unescapeMountInfo(path string) string {
+	if !strings.Contains(path, "\\") {
+		return path
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(path); i++ {
+		if path[i] == '\\' && i+4 <= len(path) {
+			if c, err := strconv.ParseUint(path[i+1:i+4], 8, 8); err == nil {
+				b.WriteByte(byte(c))
+				i += 3
+				continue
+			}
+		}
+		b.WriteByte(path[i])
+	}
+	return b.String()
+}
+
+// getRclonePID asks the rclone rc server for the PID of the rclone process
+func getRclonePID(rcAddr string) (int, error) {
+	out, err := RcloneRPC(rcAddr, "core/pid", "{}")
+	if err != nil {
+		return 0, err
+	}
+
+	var corePid rcCorePidResponse
+	if err := json.Unmarshal([]byte(out), &corePid); err != nil {
+		return 0, fmt.Errorf("cannot parse core/pid response: %v", err)
+	}
+	return corePid.Pid, nil
+}
+
+// cleanupMountStates drops the mounts of the previous nodeplugin container. rclone runs as a child of the
+// nodeplugin and ends with its container, the postStart hook unmounts the dead mounts. The pods using them
+// get an event, they need to be restarted to get the volume mounted again.
+func (ns *nodeServer) cleanupMountStates() {
+	mountContexts, err := loadMountStates(ns.stateDir)
+	if err != nil {
+		glog.Warningf("cannot load mount state from %s: %v", ns.stateDir, err)
+		return
+	}
+
+	for _, mc := range mountContexts {
+		glog.Warningf("rclone mount of volume %s at %s ended with the previous nodeplugin container, dropping mount state", mc.VolumeID, mc.TargetPath)
+		ns.recordMountEvent(mc, v1.EventTypeWarning, "MountLost",
+			fmt.Sprintf("rclone mount of volume %s ended with a restart of the csi-rclone nodeplugin, restart the pods using it to mount the volume again", mc.VolumeID))
+
+		os.RemoveAll(mc.CacheDir)
+		removeTokenDir(mountTokenDir(ns.stateDir, mc.TargetPath))
+		removeMountState(ns.stateDir, mc.TargetPath)
+	}
+}
@@ -7,8 +7,6 @@ import (
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
-	"strconv"
 	"strings"
 	"sync"
 	"time"
@@ -29,7 +27,45 @@ import (
 )
 
 type mountContext struct {
-	rcPort int
+	VolumeID string `json:"volumeId"`
+	// Path rclone is mounted at, the staging path of staged volumes
+	TargetPath   string `json:"targetPath"`
+	Remote       string `json:"remote"`
+	RcAddr       string `json:"rcAddr"`
+	CacheDir     string `json:"cacheDir"`
+	PodName      string `json:"podName,omitempty"`
+	PodNamespace string `json:"podNamespace,omitempty"`
+	PodUID       string `json:"podUid,omitempty"`
+	// Pod target paths the staged mount is bind mounted to
+	PublishPaths []string `json:"publishPaths,omitempty"`
+	// Volume capacity, the mount is made read-only while it is over quota if EnforceQuota is set
+	CapacityBytes int64 `json:"capacityBytes,omitempty"`
+	EnforceQuota  bool  `json:"enforceQuota,omitempty"`
+	OverQuota     bool  `json:"overQuota,omitempty"`
+	// Mounted with rclone --read-only, by the access mode or the volume flags
+	ReadOnly bool `json:"readOnly,omitempty"`
+	// fsGroup of the pod the mount was made for, staged mounts keep the group of the first pod
+	MountGroup string `json:"mountGroup,omitempty"`
+
+	// Mount parameters contain backend credentials, they are kept in memory only
+	params *mountParams
+	// Supervised rclone process
+	process *rcloneProcess
+	// Serializes the health check remounts with the node publish and stage calls
+	mu sync.Mutex
+	// Set while a health check of the mount is running
+	checking int32
+	// Set while a quota check of the mount is running
+	checkingQuota int32
+}
+
+type mountParams struct {
+	remote     string
+	remotePath string
+	configData string
+	flags      map[string]string
+	// Environment variables of rclone that are not flags
+	env map[string]string
 }
 
 type nodeServer struct {
@@ -38,6 +74,12 @@ type nodeServer struct {
 	mounter      *mount.SafeFormatAndMount
 	mountContext map[string]*mountContext
 	mu           sync.RWMutex
+	stateDir     string
+
+	// Backends inline ephemeral volumes may use
+	ephemeralRemotes map[string]bool
+	// rclone flags mounts start with
+	defaultFlags *defaultFlags
 }
 
 func (ns *nodeServer) getMountContext(targetPath string) *mountContext {
@@ -49,6 +91,22 @@ func (ns *nodeServer) getMountContext(targetPath string) *mountContext {
 	return &mountContext{}
 }
 
+func (ns *nodeServer) hasMountContext(mc *mountContext) bool {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	return ns.mountContext[mc.TargetPath] == mc
+}
+
+func (ns *nodeServer) listMountContexts() []*mountContext {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	mountContexts := make([]*mountContext, 0, len(ns.mountContext))
+	for _, mc := range ns.mountContext {
+		mountContexts = append(mountContexts, mc)
+	}
+	return mountContexts
+}
+
 func (ns *nodeServer) setMountContext(targetPath string, mc *mountContext) {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
@@ -57,89 +115,476 @@ func (ns *nodeServer) setMountContext(targetPath string, mc *mountContext) {
 		ns.mountContext = make(map[string]*mountContext)
 	}
 	ns.mountContext[targetPath] = mc
+
+	// persist the mount context so a restarted nodeplugin can clean up after it
+	if err := saveMountState(ns.stateDir, mc); err != nil {
+		glog.Warningf("cannot persist mount state of %s: %v", targetPath, err)
+	}
 }
 
 func (ns *nodeServer) deleteMountContext(targetPath string) {
 	ns.mu.Lock()
 	defer ns.mu.Unlock()
 	delete(ns.mountContext, targetPath)
+
+	if err := removeMountState(ns.stateDir, targetPath); err != nil {
+		glog.Warningf("cannot remove mount state of %s: %v", targetPath, err)
+	}
+}
+
+// getPublishingMountContext returns the staged mount bind mounted to targetPath, or nil
+func (ns *nodeServer) getPublishingMountContext(targetPath string) *mountContext {
+	ns.mu.RLock()
+	defer ns.mu.RUnlock()
+	for _, mc := range ns.mountContext {
+		for _, publishPath := range mc.PublishPaths {
+			if publishPath == targetPath {
+				return mc
+			}
+		}
+	}
+	return nil
+}
+
+// lookupMountContext returns the mount context serving a volume path, which is either
+// the rclone mount point itself or a pod target path of a staged mount
+func (ns *nodeServer) lookupMountContext(volumePath string) *mountContext {
+	if mc := ns.getPublishingMountContext(volumePath); mc != nil {
+		return mc
+	}
+	return ns.getMountContext(volumePath)
+}
+
+// addPublishPath records a bind mount of the staged mount, the caller holds mc.mu
+func (ns *nodeServer) addPublishPath(mc *mountContext, targetPath string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	for _, publishPath := range mc.PublishPaths {
+		if publishPath == targetPath {
+			return
+		}
+	}
+	mc.PublishPaths = append(append([]string{}, mc.PublishPaths...), targetPath)
+
+	if ns.mountContext[mc.TargetPath] == mc {
+		if err := saveMountState(ns.stateDir, mc); err != nil {
+			glog.Warningf("cannot persist mount state of %s: %v", mc.TargetPath, err)
+		}
+	}
+}
+
+// removePublishPath forgets a bind mount of the staged mount, the caller holds mc.mu
+func (ns *nodeServer) removePublishPath(mc *mountContext, targetPath string) {
+	ns.mu.Lock()
+	defer ns.mu.Unlock()
+	publishPaths := []string{}
+	for _, publishPath := range mc.PublishPaths {
+		if publishPath != targetPath {
+			publishPaths = append(publishPaths, publishPath)
+		}
+	}
+	mc.PublishPaths = publishPaths
+
+	if ns.mountContext[mc.TargetPath] == mc {
+		if err := saveMountState(ns.stateDir, mc); err != nil {
+			glog.Warningf("cannot persist mount state of %s: %v", mc.TargetPath, err)
+		}
+	}
 }
 
-func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (*csi.NodePublishVolumeResponse, error) {
-	glog.V(4).Infof("NodePublishVolume: called with args %+v", *req)
+func (ns *nodeServer) NodePublishVolume(ctx context.Context, req *csi.NodePublishVolumeRequest) (resp *csi.NodePublishVolumeResponse, err error) {
+	// Secrets hold backend credentials, only their keys are logged
+	logReq := *req
+	logReq.Secrets = redactSecrets(req.GetSecrets())
+	glog.V(4).Infof("NodePublishVolume: called with args %+v", logReq)
+	defer func(start time.Time) { observeOperation("NodePublishVolume", start, err) }(time.Now())
 
 	targetPath := req.GetTargetPath()
+	if len(targetPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodePublishVolume Target Path must be provided")
+	}
+
+	// Staged volumes share the rclone mount of the staging path, unless every pod has its own credentials.
+	// Secrets are only passed on publish for volumes with a nodePublishSecretRef, they are not staged.
+	if stagingPath := req.GetStagingTargetPath(); stagingPath != "" && !mountsPerPod(req.GetVolumeContext()) && len(req.GetSecrets()) == 0 {
+		readOnly := req.GetReadonly() || isReadOnlyAccessMode(req.GetVolumeCapability())
+		mountGroup := req.GetVolumeCapability().GetMount().GetVolumeMountGroup()
+		if err := ns.publishStagedVolume(req.GetVolumeId(), stagingPath, targetPath, readOnly, mountGroup, req.GetVolumeContext()); err != nil {
+			return nil, err
+		}
+		return &csi.NodePublishVolumeResponse{}, nil
+	}
+
+	// Kubelet republishes volumes of the CSIDriver with requiresRepublish before their token expires
+	if usesServiceAccountToken(req.GetVolumeContext()) {
+		if err := writeServiceAccountToken(ns.stateDir, targetPath, req.GetVolumeContext()); err != nil {
+			return nil, err
+		}
+	}
+
+	// Volumes without a staging path (inline ephemeral volumes) and volumes with a nodePublishSecretRef
+	// are mounted directly, with the nodePublishSecretRef secrets
+	if err := ns.mountVolume(req.GetVolumeId(), targetPath, req.GetVolumeContext(), req.GetSecrets(), req.GetVolumeCapability(), req.GetReadonly()); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodePublishVolumeResponse{}, nil
+}
+
+// mountVolume runs rclone mount of the volume at mountPath, unless a healthy mount is already there.
+// Read-only mounts (readOnly, ReadOnlyMany access mode or ro mount option) are enforced by rclone --read-only.
+func (ns *nodeServer) mountVolume(volumeID string, mountPath string, volumeContext map[string]string, secrets map[string]string, capability *csi.VolumeCapability, readOnly bool) error {
+	// Wait for a health check remount of the same mount to finish
+	previousMountContext := ns.getMountContext(mountPath)
+	previousMountContext.mu.Lock()
+	defer previousMountContext.mu.Unlock()
 
-	notMnt, err := mount.New("").IsLikelyNotMountPoint(targetPath)
+	notMnt, err := mount.New("").IsLikelyNotMountPoint(mountPath)
 	if err != nil {
 		if os.IsNotExist(err) {
-			if err := os.MkdirAll(targetPath, 0750); err != nil {
-				return nil, status.Error(codes.Internal, err.Error())
+			if err := os.MkdirAll(mountPath, 0750); err != nil {
+				return status.Error(codes.Internal, err.Error())
 			}
 			notMnt = true
 		} else {
-			return nil, status.Error(codes.Internal, err.Error())
+			return status.Error(codes.Internal, err.Error())
 		}
 	}
 
 	if !notMnt {
 		// testing original mount point, make sure the mount link is valid
-		if _, err := ioutil.ReadDir(targetPath); err == nil {
-			glog.V(4).Infof("already mounted to target %s", targetPath)
-			return &csi.NodePublishVolumeResponse{}, nil
+		err := checkMountpoint(mountPath)
+		if err == nil {
+			glog.V(4).Infof("already mounted to target %s", mountPath)
+			return nil
 		}
 		// todo: mount link is invalid, now unmount and remount later (built-in functionality)
-		glog.Warningf("ReadDir %s failed with %v, unmount this directory", targetPath, err)
+		glog.Warningf("Stat %s failed with %v, unmount this directory", mountPath, err)
+
+		// Do not let the supervisor restart the broken mount behind our back
+		if previousMountContext.process != nil {
+			previousMountContext.process.Stop()
+		}
 
 		ns.mounter = &mount.SafeFormatAndMount{
 			Interface: mount.New(""),
 			Exec:      mount.NewOsExec(),
 		}
 
-		if err := ns.mounter.Unmount(targetPath); err != nil {
-			glog.Errorf("Unmount directory %s failed with %v", targetPath, err)
-			return nil, err
+		if err := ns.mounter.Unmount(mountPath); err != nil {
+			glog.Errorf("Unmount directory %s failed with %v", mountPath, err)
+			return err
 		}
 	}
 
-	mountOptions := req.GetVolumeCapability().GetMount().GetMountFlags()
-	if req.GetReadonly() {
-		mountOptions = append(mountOptions, "ro")
+	// Load default connection settings from secret, inline volumes only get the pod namespace secret and
+	// per-pod credentials must not be completed with the cluster credentials
+	var secret *v1.Secret
+	if isEphemeral(volumeContext) {
+		if e := ns.validateEphemeralVolume(volumeContext, secrets); e != nil {
+			return e
+		}
+	} else {
+		if len(secrets) > 0 {
+			if e := validateVolumeSecrets(volumeID, secrets); e != nil {
+				return e
+			}
+		}
+		if !mountsPerPod(volumeContext) {
+			secret = getDefaultSecret(volumeContext, secrets)
+		}
 	}
 
-	// Load default connection settings from secret
-	secret, _ := getSecret("rclone-secret")
+	// The credentials of the pod service account override the volume secrets
+	if isPodIdentity(volumeContext) {
+		identitySecrets, e := getPodIdentitySecrets(volumeContext)
+		if e != nil {
+			return e
+		}
+		merged := map[string]string{}
+		for k, v := range secrets {
+			merged[k] = v
+		}
+		for k, v := range identitySecrets {
+			merged[k] = v
+		}
+		secrets = merged
+	}
 
-	remote, remotePath, configData, flags, e := extractFlags(req.GetVolumeContext(), secret)
+	mountFlags, e := translateMountFlags(capability.GetMount().GetMountFlags())
+	if e != nil {
+		return e
+	}
+
+	defaults, e := ns.defaultFlags.forVolume(volumeContext)
+	if e != nil {
+		return e
+	}
+
+	remote, remotePath, configData, flags, e := extractFlags(volumeContext, secret, secrets, mountFlags, defaults)
 	if e != nil {
 		glog.Warningf("storage parameter error: %s", e)
-		return nil, e
+		return e
+	}
+
+	if readOnly || isReadOnlyAccessMode(capability) || isReadOnlyFlag(mountFlags) {
+		flags["read-only"] = "true"
+	}
+
+	// Pods with an fsGroup can write to the mount
+	uid, gid := mountOwnership(capability, volumeContext)
+	applyOwnershipFlags(flags, []map[string]string{volumeContext, mountFlags}, uid, gid)
+	// Mounts with an explicit gid are not owned by the fsGroup, pods with any fsGroup share them
+	mountGroup := capability.GetMount().GetVolumeMountGroup()
+	if flags["gid"] != mountGroup {
+		mountGroup = ""
 	}
 
-	rcPort, e := Mount(remote, remotePath, targetPath, configData, flags)
+	// Backend credentials exchanged for the service account token of the pod
+	env := map[string]string{}
+	if usesServiceAccountToken(volumeContext) {
+		if e := applyTokenFederation(ns.stateDir, mountPath, volumeContext, flags, env); e != nil {
+			return e
+		}
+	}
+
+	if ns.Driver.printEffectiveFlags {
+		secretFlags := map[string]string{}
+		if secret != nil {
+			for k, v := range secret.Data {
+				secretFlags[k] = string(v)
+			}
+		}
+		glog.Infof("Effective rclone flags of volume %s at %s:\n%s", volumeID, mountPath, describeEffectiveFlags(flags, []flagLayer{
+			{name: "defaults", flags: defaults},
+			{name: "rclone-secret", flags: secretFlags, secret: true},
+			{name: "volume secret", flags: secrets, secret: true},
+			{name: "mount options", flags: mountFlags},
+			{name: "volume context", flags: volumeContext},
+		}))
+	}
+
+	capacity, enforceQuota, e := parseCapacity(volumeContext)
 	if e != nil {
+		return e
+	}
+	if capacity > 0 {
+		capacity = expandedCapacity(volumeID, capacity)
+	}
+	applyCapacityFlags(flags, capacity)
+
+	// Encrypted volumes mount a crypt remote wrapping the volume remote
+	if encryption := volumeContext[encryptionParameter]; encryption != "" {
+		if e := validateEncryption(encryption); e != nil {
+			return e
+		}
+		password, password2, e := getCryptKeys(volumeContext)
+		if e != nil {
+			return e
+		}
+		if remote, remotePath, configData, e = wrapCryptRemote(remote, remotePath, configData, password, password2); e != nil {
+			return status.Errorf(codes.Internal, "can not configure crypt remote of volume %s: %s", volumeID, e)
+		}
+	}
+
+	mc := &mountContext{
+		VolumeID:   volumeID,
+		TargetPath: mountPath,
+		Remote:     getRemoteWithPath(remote, remotePath, configData),
+		CacheDir:   vfsCacheDir(mountPath),
+		// provided by kubelet on publish since CSIDriver sets podInfoOnMount, staged mounts are shared by pods
+		PodName:      volumeContext["csi.storage.k8s.io/pod.name"],
+		PodNamespace: volumeContext["csi.storage.k8s.io/pod.namespace"],
+		PodUID:       volumeContext["csi.storage.k8s.io/pod.uid"],
+		// a restaged broken mount keeps serving the pods it was published to
+		PublishPaths:  previousMountContext.PublishPaths,
+		CapacityBytes: capacity,
+		EnforceQuota:  enforceQuota,
+		ReadOnly:      isReadOnlyFlag(flags),
+		MountGroup:    mountGroup,
+		params: &mountParams{
+			remote:     remote,
+			remotePath: remotePath,
+			configData: configData,
+			flags:      flags,
+			env:        env,
+		},
+	}
+
+	if e := ns.mount(mc); e != nil {
 		if os.IsPermission(e) {
-			return nil, status.Error(codes.PermissionDenied, e.Error())
+			return status.Error(codes.PermissionDenied, e.Error())
 		}
 		if strings.Contains(e.Error(), "invalid argument") {
-			return nil, status.Error(codes.InvalidArgument, e.Error())
+			return status.Error(codes.InvalidArgument, e.Error())
 		}
-		return nil, status.Error(codes.Internal, e.Error())
+		return status.Error(codes.Internal, e.Error())
 	}
 
 	// Save the mount context
-	ns.setMountContext(targetPath, &mountContext{
-		rcPort: rcPort,
-	})
+	ns.setMountContext(mountPath, mc)
 
-	return &csi.NodePublishVolumeResponse{}, nil
+	return nil
+}
+
+// publishStagedVolume bind mounts the rclone mount of the staging path into the pod target path
+func (ns *nodeServer) publishStagedVolume(volumeID string, stagingPath string, targetPath string, readOnly bool, mountGroup string, volumeContext map[string]string) error {
+	mc := ns.getMountContext(stagingPath)
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	// The rclone mount is owned by the fsGroup it was staged with, pods with another fsGroup could not write.
+	// They get their own mount.
+	if mountGroup != "" && mc.MountGroup != "" && mountGroup != mc.MountGroup {
+		return ns.mountForGroup(mc, targetPath, readOnly, mountGroup, volumeContext)
+	}
+
+	m := mount.New("")
+
+	stagingNotMnt, err := m.IsLikelyNotMountPoint(stagingPath)
+	if err != nil || stagingNotMnt {
+		return status.Errorf(codes.FailedPrecondition, "volume %s is not staged at %s", volumeID, stagingPath)
+	}
+
+	notMnt, err := m.IsLikelyNotMountPoint(targetPath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			if err := os.MkdirAll(targetPath, 0750); err != nil {
+				return status.Error(codes.Internal, err.Error())
+			}
+			notMnt = true
+		} else if !mount.IsCorruptedMnt(err) {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	if !notMnt {
+		if err := checkMountpoint(targetPath); err == nil {
+			glog.V(4).Infof("volume %s already bind mounted to target %s", volumeID, targetPath)
+			ns.addPublishPath(mc, targetPath)
+			return nil
+		}
+		// A bind mount of a remounted staging path still points to the old rclone mount
+		glog.Warningf("bind mount %s is broken, mounting it again", targetPath)
+		if err := m.Unmount(targetPath); err != nil {
+			return status.Error(codes.Internal, err.Error())
+		}
+	}
+
+	options := []string{"bind"}
+	if readOnly {
+		options = append(options, "ro")
+	}
+
+	if err := m.Mount(stagingPath, targetPath, "", options); err != nil {
+		return status.Errorf(codes.Internal, "cannot bind mount %s to %s: %v", stagingPath, targetPath, err)
+	}
+
+	if ns.hasMountContext(mc) {
+		ns.addPublishPath(mc, targetPath)
+	} else {
+		glog.Warningf("rclone mount of volume %s at %s is not tracked by the nodeplugin", volumeID, stagingPath)
+	}
+
+	return nil
+}
+
+// mountForGroup mounts a staged volume at the target path of a pod with another fsGroup than the one it was
+// staged with. The mount gets the parameters of the staged mount, kubelet passes the stage secrets on stage
+// only, and the fsGroup of the pod. The caller holds staged.mu.
+func (ns *nodeServer) mountForGroup(staged *mountContext, targetPath string, readOnly bool, mountGroup string, volumeContext map[string]string) error {
+	m := mount.New("")
+	notMnt, err := m.IsLikelyNotMountPoint(targetPath)
+	if err != nil && !os.IsNotExist(err) && !mount.IsCorruptedMnt(err) {
+		return status.Error(codes.Internal, err.Error())
+	}
+	if err == nil && !notMnt {
+		if existing := ns.getMountContext(targetPath); ns.hasMountContext(existing) && checkMountpoint(targetPath) == nil {
+			glog.V(4).Infof("volume %s already mounted for fsGroup %s at %s", staged.VolumeID, mountGroup, targetPath)
+			return nil
+		}
+		lazyUnmount(targetPath)
+	}
+
+	if err := os.MkdirAll(targetPath, 0750); err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	flags := map[string]string{}
+	for k, v := range staged.params.flags {
+		flags[k] = v
+	}
+	flags["gid"] = mountGroup
+	if readOnly {
+		flags["read-only"] = "true"
+	}
+
+	glog.Infof("Volume %s is staged for fsGroup %s, mounting it for fsGroup %s at %s", staged.VolumeID, staged.MountGroup, mountGroup, targetPath)
+	mc := &mountContext{
+		VolumeID:      staged.VolumeID,
+		TargetPath:    targetPath,
+		Remote:        staged.Remote,
+		CacheDir:      vfsCacheDir(targetPath),
+		PodName:       volumeContext["csi.storage.k8s.io/pod.name"],
+		PodNamespace:  volumeContext["csi.storage.k8s.io/pod.namespace"],
+		PodUID:        volumeContext["csi.storage.k8s.io/pod.uid"],
+		CapacityBytes: staged.CapacityBytes,
+		EnforceQuota:  staged.EnforceQuota,
+		ReadOnly:      isReadOnlyFlag(flags),
+		MountGroup:    mountGroup,
+		params: &mountParams{
+			remote:     staged.params.remote,
+			remotePath: staged.params.remotePath,
+			configData: staged.params.configData,
+			flags:      flags,
+			env:        staged.params.env,
+		},
+	}
+
+	if err := ns.mount(mc); err != nil {
+		return status.Errorf(codes.Internal, "cannot mount volume %s for fsGroup %s: %v", staged.VolumeID, mountGroup, err)
+	}
+	ns.setMountContext(targetPath, mc)
+
+	return nil
 }
 
-func extractFlags(volumeContext map[string]string, secret *v1.Secret) (string, string, string, map[string]string, error) {
+// mount starts rclone with the saved mount parameters and records its rc address
+func (ns *nodeServer) mount(mc *mountContext) error {
+	p := mc.params
+
+	configDir := mountConfigDir(ns.stateDir, mc.TargetPath)
+
+	process, err := Mount(mc.VolumeID, p.remote, p.remotePath, mc.TargetPath, mc.CacheDir, configDir, p.configData, p.flags, p.env)
+	if err != nil {
+		mountFailuresTotal.Inc()
+		removeConfigDir(configDir)
+		return err
+	}
+
+	mc.process = process
+	mc.RcAddr = process.rcAddr
+
+	process.setOnRestart(func() { ns.rebindRestartedMount(mc, process) })
+
+	return nil
+}
+
+// extractFlags merges the rclone flags of a volume, in order of precedence (lowest first):
+//  1. the nodeplugin default flags and the flag profile of the volume (defaultFlags.forVolume)
+//  2. the csi-rclone connection defaults secret (rclone-secret), see getDefaultSecret
+//  3. the volume secrets passed by the CO (nodeStageSecretRef or nodePublishSecretRef, provisioner secret)
+//  4. the PV mountOptions (StorageClass mountOptions), translated by translateMountFlags
+//  5. the volume context (PV volumeAttributes)
+func extractFlags(volumeContext map[string]string, secret *v1.Secret, secrets map[string]string, mountFlags map[string]string, defaults map[string]string) (string, string, string, map[string]string, error) {
 
 	// Empty argument list
 	flags := make(map[string]string)
 
+	for k, v := range defaults {
+		flags[k] = v
+	}
+
 	// Secret values are default, gets merged and overriden by corresponding PV values
 	if secret != nil && secret.Data != nil && len(secret.Data) > 0 {
 
@@ -151,6 +596,17 @@ func extractFlags(volumeContext map[string]string, secret *v1.Secret) (string, s
 		glog.V(4).Infof("No csi-rclone connection defaults secret found.")
 	}
 
+	// Per volume secret values override the defaults
+	if len(secrets) > 0 {
+		for k, v := range secrets {
+			flags[k] = v
+		}
+	}
+
+	for k, v := range mountFlags {
+		flags[k] = v
+	}
+
 	if len(volumeContext) > 0 {
 		for k, v := range volumeContext {
 			flags[k] = v
@@ -179,6 +635,39 @@ func extractFlags(volumeContext map[string]string, secret *v1.Secret) (string, s
 	delete(flags, "remote")
 	delete(flags, "remotePath")
 
+	// Controller only settings
+	delete(flags, "onDelete")
+
+	// The connection defaults are applied by getDefaultSecret
+	delete(flags, inheritRcloneSecretParameter)
+
+	// Pod identity is applied by getPodIdentitySecrets
+	delete(flags, podIdentityParameter)
+
+	// The profile is applied by defaultFlags.forVolume
+	delete(flags, flagProfileParameter)
+
+	// Service account token federation is applied by applyTokenFederation
+	for _, key := range tokenFederationParameters {
+		delete(flags, key)
+	}
+
+	// Capacity is applied by applyCapacityFlags
+	delete(flags, capacityParameter)
+	delete(flags, enforceQuotaParameter)
+
+	// Encryption is applied by wrapCryptRemote
+	delete(flags, encryptionParameter)
+	delete(flags, encryptionKeySecretNameParameter)
+	delete(flags, encryptionKeySecretNamespaceParameter)
+
+	// Pod info and other keys provided by kubelet are not rclone flags
+	for k := range flags {
+		if strings.HasPrefix(k, "csi.storage.k8s.io/") {
+			delete(flags, k)
+		}
+	}
+
 	return remote, remotePath, configData, flags, nil
 }
 
@@ -186,18 +675,32 @@ func extractFlags(volumeContext map[string]string, secret *v1.Secret) (string, s
 type rcCoreStatsResponse struct {
 	// an array of currently active file transfers
 	Transferring map[string]interface{} `json:"transferring"`
+	Bytes        int64                  `json:"bytes"`
+	Errors       int64                  `json:"errors"`
+	Transfers    int64                  `json:"transfers"`
 }
 
 // https://rclone.org/rc/#vfs-stats
 type rcVfsStatsResponse struct {
 	DiskCache struct {
+		BytesUsed         int64 `json:"bytesUsed"`
+		ErroredFiles      int64 `json:"erroredFiles"`
+		OutOfSpace        bool  `json:"outOfSpace"`
 		UploadsInProgress int64 `json:"uploadsInProgress"`
 		UploadsQueued     int64 `json:"uploadsQueued"`
 	} `json:"diskCache"`
 }
 
+// rcTimeout bounds rc calls so a hung rclone process can not block the caller forever
+const rcTimeout = 30 * time.Second
+
 // RcloneRPC is a helper function to call rclone rc server
 func RcloneRPC(host string, method string, input string) (output string, err error) {
+	return rcloneRPCWithTimeout(host, method, input, rcTimeout)
+}
+
+// rcloneRPCWithTimeout calls the rclone rc server like RcloneRPC, with the given timeout
+func rcloneRPCWithTimeout(host string, method string, input string, timeout time.Duration) (output string, err error) {
 	url := fmt.Sprintf("http://%s/%s", host, method)
 
 	// Create a POST request to API
@@ -210,7 +713,7 @@ func RcloneRPC(host string, method string, input string) (output string, err err
 	req.Header.Set("Content-Type", "application/json")
 
 	// Create a new HTTP client
-	client := &http.Client{}
+	client := &http.Client{Timeout: timeout}
 
 	// Send the request via the client
 	resp, err := client.Do(req)
@@ -227,99 +730,234 @@ func RcloneRPC(host string, method string, input string) (output string, err err
 		return "", fmt.Errorf("cannot read HTTP response: %v", err)
 	}
 
+	// rc errors are returned as {"error": "..."} with a non 200 status
+	if resp.StatusCode != http.StatusOK {
+		return string(body), fmt.Errorf("%s returned %s: %s", method, resp.Status, strings.TrimSpace(string(body)))
+	}
+
 	// Return the response body as a string
 	return string(body), nil
 }
 
-func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (*csi.NodeUnpublishVolumeResponse, error) {
+func (ns *nodeServer) NodeUnpublishVolume(ctx context.Context, req *csi.NodeUnpublishVolumeRequest) (resp *csi.NodeUnpublishVolumeResponse, err error) {
+	defer func(start time.Time) { observeOperation("NodeUnpublishVolume", start, err) }(time.Now())
 
 	targetPath := req.GetTargetPath()
 	if len(targetPath) == 0 {
 		return nil, status.Error(codes.InvalidArgument, "NodeUnpublishVolume Target Path must be provided")
 	}
 
-	mountContext := ns.getMountContext(targetPath)
-	rcPort := mountContext.rcPort
+	// Only the bind mount of a staged volume is removed, NodeUnstageVolume unmounts rclone
+	if mc := ns.getPublishingMountContext(targetPath); mc != nil {
+		mc.mu.Lock()
+		defer mc.mu.Unlock()
+
+		if err := unmountPath(req.GetVolumeId(), targetPath); err != nil {
+			return nil, err
+		}
+		ns.removePublishPath(mc, targetPath)
+
+		return &csi.NodeUnpublishVolumeResponse{}, nil
+	}
+
+	if err := ns.unmountVolume(req.GetVolumeId(), targetPath); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeUnpublishVolumeResponse{}, nil
+}
 
-	if rcPort != 0 {
-		// Connect to rclone rpc server and query the operation status
-		// If the rclone process is still running, wait for it to finish cache sync
-		// If the rclone process is not running, proceed to volume unmount
+// unmountVolume waits for the VFS cache uploads of the rclone mount at mountPath, stops rclone and unmounts it
+func (ns *nodeServer) unmountVolume(volumeID string, mountPath string) error {
+	mountContext := ns.getMountContext(mountPath)
+	mountContext.mu.Lock()
+	defer mountContext.mu.Unlock()
+	rcAddr := mountContext.RcAddr
 
-		// check the state of the rclone process until it finishes the cache sync
+	if rcAddr != "" {
 		// Hard timeout is 1 hour
-		copyTimeout := time.Now().Add(1 * time.Hour)
-		for copyTimeout.After(time.Now()) {
+		drainStart := time.Now()
+		waitForUploads(rcAddr, 1*time.Hour)
+		unpublishDrainDuration.Observe(time.Since(drainStart).Seconds())
+
+		// rclone unmounts the target when it's terminated
+		if mountContext.process != nil {
+			mountContext.process.Stop()
+		}
+		removeConfigDir(mountConfigDir(ns.stateDir, mountPath))
 
-			// Try to load https://localhost:5572/core/stats and parse the JSON response
-			out, err := RcloneRPC(fmt.Sprintf("localhost:%s", strconv.Itoa(rcPort)), "core/stats", "{}")
+		// Remove VFS cache
+		os.RemoveAll(mountContext.CacheDir)
+	}
+
+	removeTokenDir(mountTokenDir(ns.stateDir, mountPath))
+
+	// Remove mount context
+	ns.deleteMountContext(mountPath)
+
+	return unmountPath(volumeID, mountPath)
+}
+
+// waitForUploads waits until the rclone process at rcAddr has no transfers and no VFS cache uploads left,
+// or timeout has passed. It returns right away if the rclone process is not running.
+func waitForUploads(rcAddr string, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	for deadline.After(time.Now()) {
+
+		// Try to load https://localhost:5572/core/stats and parse the JSON response
+		out, err := RcloneRPC(rcAddr, "core/stats", "{}")
+		if err == nil {
+			var coreStats rcCoreStatsResponse
+			err = json.Unmarshal([]byte(out), &coreStats)
 			if err == nil {
-				var coreStats rcCoreStatsResponse
-				err = json.Unmarshal([]byte(out), &coreStats)
-				if err == nil {
-					if len(coreStats.Transferring) > 0 {
-						time.Sleep(5 * time.Second)
-						continue
-					}
+				if len(coreStats.Transferring) > 0 {
+					time.Sleep(5 * time.Second)
+					continue
 				}
-
 			}
 
-			// Try to load https://localhost:5572/vfs/stats and parse the JSON response
-			out, err = RcloneRPC(fmt.Sprintf("localhost:%s", strconv.Itoa(rcPort)), "vfs/stats", "{}")
+		}
+
+		// Try to load https://localhost:5572/vfs/stats and parse the JSON response
+		out, err = RcloneRPC(rcAddr, "vfs/stats", "{}")
+		if err == nil {
+			var vfsStats rcVfsStatsResponse
+			err = json.Unmarshal([]byte(out), &vfsStats)
 			if err == nil {
-				var vfsStats rcVfsStatsResponse
-				err = json.Unmarshal([]byte(out), &vfsStats)
-				if err == nil {
-					if vfsStats.DiskCache.UploadsInProgress > 0 || vfsStats.DiskCache.UploadsQueued > 0 {
-						time.Sleep(5 * time.Second)
-						continue
-					}
+				if vfsStats.DiskCache.UploadsInProgress > 0 || vfsStats.DiskCache.UploadsQueued > 0 {
+					time.Sleep(5 * time.Second)
+					continue
 				}
 			}
-
-			// proceed to volume unmount
-			break
 		}
 
-		// Remove VFS cache
-		os.RemoveAll("/tmp/rclone-vfs-cache/" + targetPath)
+		return
 	}
+}
 
-	// Remove mount context
-	ns.deleteMountContext(targetPath)
+// checkMountpoint fails on a mount left behind by a dead rclone process ("transport endpoint is not
+// connected"). It only stats the mountpoint, listing it would list the remote.
+func checkMountpoint(mountPath string) error {
+	_, err := os.Stat(mountPath)
+	return err
+}
 
+// unmountPath unmounts a leftover mount and removes the mount point
+func unmountPath(volumeID string, mountPath string) error {
 	m := mount.New("")
 
-	notMnt, err := m.IsLikelyNotMountPoint(targetPath)
+	notMnt, err := m.IsLikelyNotMountPoint(mountPath)
 	if err != nil && !mount.IsCorruptedMnt(err) {
-		return nil, status.Error(codes.Internal, err.Error())
+		if os.IsNotExist(err) {
+			return nil
+		}
+		return status.Error(codes.Internal, err.Error())
 	}
 
 	if notMnt && !mount.IsCorruptedMnt(err) {
 		glog.V(4).Infof("Volume not mounted")
 
 	} else {
-		err = util.UnmountPath(req.GetTargetPath(), m)
+		err = util.UnmountPath(mountPath, m)
 		if err != nil {
 			glog.V(4).Infof("Error while unmounting path: %s", err)
 			// This will exit and fail the NodeUnpublishVolume making it to retry unmount on the next api schedule trigger.
 			// Since we mount the volume with allow-non-empty now, we could skip this one too.
-			return nil, status.Error(codes.Internal, err.Error())
+			return status.Error(codes.Internal, err.Error())
 		}
 
-		glog.V(4).Infof("Volume %s unmounted successfully", req.VolumeId)
+		glog.V(4).Infof("Volume %s unmounted successfully", volumeID)
 	}
 
-	return &csi.NodeUnpublishVolumeResponse{}, nil
+	return nil
+}
+
+func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (resp *csi.NodeStageVolumeResponse, err error) {
+	logReq := *req
+	logReq.Secrets = redactSecrets(req.GetSecrets())
+	glog.V(4).Infof("NodeStageVolume: called with args %+v", logReq)
+	defer func(start time.Time) { observeOperation("NodeStageVolume", start, err) }(time.Now())
+
+	if len(req.GetVolumeId()) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Volume ID must be provided")
+	}
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeStageVolume Staging Target Path must be provided")
+	}
+
+	// Volumes with podIdentity or service account tokens are mounted per pod on publish, with the credentials of the pod
+	if mountsPerPod(req.GetVolumeContext()) {
+		glog.V(4).Infof("Volume %s uses pod credentials, it is mounted on publish", req.GetVolumeId())
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// The secrets of the PV nodePublishSecretRef (StorageClass csi.storage.k8s.io/node-publish-secret-name)
+	// are not passed on stage, mounting without them would fall back to the rclone-secret credentials
+	publishSecrets, err := usesPublishSecrets(req.GetVolumeId())
+	if err != nil {
+		return nil, err
+	}
+	if publishSecrets {
+		glog.V(4).Infof("Volume %s has a nodePublishSecretRef, it is mounted on publish", req.GetVolumeId())
+		return &csi.NodeStageVolumeResponse{}, nil
+	}
+
+	// Secrets referenced by the PV nodeStageSecretRef (StorageClass csi.storage.k8s.io/node-stage-secret-name),
+	// the staged mount is shared by all pods so pod readOnly is applied to the bind mounts
+	if err := ns.mountVolume(req.GetVolumeId(), stagingPath, req.GetVolumeContext(), req.GetSecrets(), req.GetVolumeCapability(), false); err != nil {
+		return nil, err
+	}
+
+	return &csi.NodeStageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (*csi.NodeUnstageVolumeResponse, error) {
+// usesPublishSecrets returns whether the PV of a volume references a nodePublishSecretRef, such volumes
+// are mounted per pod on publish like before volumes were staged
+func usesPublishSecrets(volumeID string) (bool, error) {
+	pv, err := getPersistentVolume(volumeID)
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "can not load PV of volume %s: %s", volumeID, err)
+	}
+	return pv != nil && pv.Spec.CSI.NodePublishSecretRef != nil, nil
+}
+
+func (ns *nodeServer) NodeUnstageVolume(ctx context.Context, req *csi.NodeUnstageVolumeRequest) (resp *csi.NodeUnstageVolumeResponse, err error) {
+	defer func(start time.Time) { observeOperation("NodeUnstageVolume", start, err) }(time.Now())
+
+	stagingPath := req.GetStagingTargetPath()
+	if len(stagingPath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeUnstageVolume Staging Target Path must be provided")
+	}
+
+	mc := ns.getMountContext(stagingPath)
+	mc.mu.Lock()
+	// Bind mounts that are gone (i.e. removed by a node reboot) do not keep the volume staged
+	if mountPoints, err := getMountPoints(); err == nil {
+		for _, publishPath := range mc.PublishPaths {
+			if !mountPoints[publishPath] {
+				ns.removePublishPath(mc, publishPath)
+			}
+		}
+	}
+	publishPaths := mc.PublishPaths
+	mc.mu.Unlock()
+
+	if len(publishPaths) > 0 {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s is still published to %s", req.GetVolumeId(), strings.Join(publishPaths, ", "))
+	}
+
+	if err := ns.unmountVolume(req.GetVolumeId(), stagingPath); err != nil {
+		return nil, err
+	}
+
 	return &csi.NodeUnstageVolumeResponse{}, nil
 }
 
-func (ns *nodeServer) NodeStageVolume(ctx context.Context, req *csi.NodeStageVolumeRequest) (*csi.NodeStageVolumeResponse, error) {
-	return &csi.NodeStageVolumeResponse{}, nil
+func (ns *nodeServer) NodeGetCapabilities(ctx context.Context, req *csi.NodeGetCapabilitiesRequest) (*csi.NodeGetCapabilitiesResponse, error) {
+	return &csi.NodeGetCapabilitiesResponse{
+		Capabilities: ns.Driver.nscap,
+	}, nil
 }
 
 func validateFlags(flags map[string]string) error {
@@ -338,14 +976,9 @@ func getSecret(secretName string) (*v1.Secret, error) {
 		return nil, status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
 	}
 
-	kubeconfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
-		clientcmd.NewDefaultClientConfigLoadingRules(),
-		&clientcmd.ConfigOverrides{},
-	)
-
-	namespace, _, err := kubeconfig.Namespace()
+	namespace, err := getDriverNamespace()
 	if err != nil {
-		return nil, status.Errorf(codes.Internal, "can't get current namespace, error %s", secretName, err)
+		return nil, err
 	}
 
 	glog.V(4).Infof("Loading csi-rclone connection defaults from secret %s/%s", namespace, secretName)
@@ -361,6 +994,45 @@ func getSecret(secretName string) (*v1.Secret, error) {
 	return secret, nil
 }
 
+// redactSecrets returns the keys of secrets with redacted values, for logging requests
+func redactSecrets(secrets map[string]string) map[string]string {
+	redacted := make(map[string]string, len(secrets))
+	for k := range secrets {
+		redacted[k] = "<redacted>"
+	}
+	return redacted
+}
+
+// Volume context key opting volumes with their own secret into the rclone-secret connection defaults
+const inheritRcloneSecretParameter = "inheritRcloneSecret"
+
+// getDefaultSecret loads the rclone-secret connection defaults of a volume. Volumes with their own secret
+// only get them with inheritRcloneSecret, a secret setting some of the backend keys would otherwise be
+// completed with the cluster credentials.
+func getDefaultSecret(volumeContext map[string]string, secrets map[string]string) *v1.Secret {
+	if len(secrets) > 0 && volumeContext[inheritRcloneSecretParameter] != "true" {
+		glog.V(4).Infof("Volume has its own secret, not using the csi-rclone connection defaults.")
+		return nil
+	}
+	secret, _ := getSecret("rclone-secret")
+	return secret
+}
+
+// getDriverNamespace returns the namespace the plugin runs in
+func getDriverNamespace() (string, error) {
+	kubeconfig := clientcmd.NewNonInteractiveDeferredLoadingClientConfig(
+		clientcmd.NewDefaultClientConfigLoadingRules(),
+		&clientcmd.ConfigOverrides{},
+	)
+
+	namespace, _, err := kubeconfig.Namespace()
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "can't get current namespace, error %s", err)
+	}
+
+	return namespace, nil
+}
+
 func flagToEnvName(flag string) string {
 	// To find the name of the environment variable, first, take the long option name, strip the leading --, change - to _, make upper case and prepend RCLONE_.
 	flag = strings.TrimPrefix(flag, "--") // we dont pass prefixed args, but strictly this is the algorithm
@@ -382,20 +1054,9 @@ func getFreePort() (port int, err error) {
 	return 0, err
 }
 
-// Mount routine.
-func Mount(remote string, remotePath string, targetPath string, configData string, flags map[string]string) (rcPort int, err error) {
-	mountCmd := "rclone"
-	mountArgs := []string{}
-
-	defaultFlags := map[string]string{}
-	defaultFlags["cache-info-age"] = "72h"
-	defaultFlags["cache-chunk-clean-interval"] = "15m"
-	defaultFlags["dir-cache-time"] = "5s"
-	defaultFlags["vfs-cache-mode"] = "writes"
-	defaultFlags["cache-dir"] = "/tmp/rclone-vfs-cache/" + targetPath
-	defaultFlags["allow-non-empty"] = "true"
-	defaultFlags["allow-other"] = "true"
-
+// getRemoteWithPath returns the rclone remote:path argument, remotes missing from configData
+// are addressed as on the fly backends (:backend:path) configured by flags
+func getRemoteWithPath(remote string, remotePath string, configData string) string {
 	remoteWithPath := fmt.Sprintf(":%s:%s", remote, remotePath)
 
 	if strings.Contains(configData, "["+remote+"]") {
@@ -403,48 +1064,45 @@ func Mount(remote string, remotePath string, targetPath string, configData strin
 		glog.V(4).Infof("remote %s found in configData, remoteWithPath set to %s", remote, remoteWithPath)
 	}
 
+	return remoteWithPath
+}
+
+// vfsCacheDir returns the default VFS cache directory of a mount
+func vfsCacheDir(targetPath string) string {
+	return "/tmp/rclone-vfs-cache/" + targetPath
+}
+
+// Mount routine.
+func Mount(volumeID string, remote string, remotePath string, targetPath string, cacheDir string, configDir string, configData string, flags map[string]string, extraEnv map[string]string) (*rcloneProcess, error) {
+	mountArgs := []string{}
+
+	// Other defaults are configured with --default-flags and flag profiles
+	defaultFlags := map[string]string{}
+	defaultFlags["cache-dir"] = cacheDir
+
+	remoteWithPath := getRemoteWithPath(remote, remotePath, configData)
+
 	// Find a free port for rclone rc
-	rcPort, err = getFreePort()
+	rcPort, err := getFreePort()
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
+	rcAddr := fmt.Sprintf("localhost:%d", rcPort)
 
 	// rclone mount remote:path /path/to/mountpoint [flags]
+	// rclone runs in the foreground, supervised by the nodeplugin
 	mountArgs = append(
 		mountArgs,
 		"mount",
 		remoteWithPath,
 		targetPath,
 		"--rc",
-		"--rc-addr="+fmt.Sprintf("localhost:%d", rcPort),
-		"--daemon",
-		"--daemon-wait=0",
+		"--rc-addr="+rcAddr,
 	)
 
-	// If a custom flag configData is defined,
-	// create a temporary file, fill it with  configData content,
-	// and run rclone with --config <tmpfile> flag
-	if configData != "" {
-
-		configFile, err := ioutil.TempFile("", "rclone.conf")
-		if err != nil {
-			return 0, err
-		}
-
-		// Normally, a defer os.Remove(configFile.Name()) should be placed here.
-		// However, due to a rclone mount --daemon flag, rclone forks and creates a race condition
-		// with this nodeplugin proceess. As a result, the config file gets deleted
-		// before it's reread by a forked process.
-
-		if _, err := configFile.Write([]byte(configData)); err != nil {
-			return 0, err
-		}
-		if err := configFile.Close(); err != nil {
-			return 0, err
-		}
-
-		mountArgs = append(mountArgs, "--config", configFile.Name())
-	} else {
+	// If a custom flag configData is defined, it's written to a config file
+	// in configDir and passed with --config on each rclone start
+	if configData == "" {
 		// Disable "config not found" notice
 		mountArgs = append(mountArgs, "--config=''")
 	}
@@ -464,22 +1122,26 @@ func Mount(remote string, remotePath string, targetPath string, configData strin
 		env = append(env, fmt.Sprintf("%s=%s", flagToEnvName(k), v))
 	}
 
+	// Add settings of the backend SDKs
+	for k, v := range extraEnv {
+		env = append(env, fmt.Sprintf("%s=%s", k, v))
+	}
+
 	// create target, os.Mkdirall is noop if it exists
 	err = os.MkdirAll(targetPath, 0750)
 	if err != nil {
-		return 0, err
+		return nil, err
 	}
 
-	glog.V(4).Infof("executing mount command cmd=%s, remote=%s, targetpath=%s", mountCmd, remoteWithPath, targetPath)
+	glog.V(4).Infof("executing mount command cmd=rclone, remote=%s, targetpath=%s", remoteWithPath, targetPath)
 	glog.V(4).Infof("mountArgs: %v", mountArgs)
 
-	cmd := exec.Command(mountCmd, mountArgs...)
-	cmd.Env = env
-	out, err := cmd.CombinedOutput()
-	if err != nil {
-		return 0, fmt.Errorf("mounting failed: %v cmd: '%s' remote: '%s' targetpath: %s output: %q",
-			err, mountCmd, remoteWithPath, targetPath, string(out))
+	process := newRcloneProcess(volumeID, targetPath, rcAddr, mountArgs, env, configDir, configData)
+	if err := process.start(); err != nil {
+		return nil, fmt.Errorf("mounting failed: %v cmd: 'rclone' remote: '%s' targetpath: %s",
+			err, remoteWithPath, targetPath)
 	}
+	go process.supervise()
 
-	return rcPort, nil
+	return process, nil
 }
@@ -0,0 +1,299 @@
+package rclone
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// pathTemplate holds the values a pathPattern can reference:
+//
+//	${.PVC.name} ${.PVC.namespace} ${.PVC.uid} ${.PVC.labels.<key>} ${.PVC.annotations.<key>}
+//	${.PV.name} ${.StorageClass.name} ${.Namespace.labels.<key>} ${.Namespace.annotations.<key>}
+//
+// Values can be piped through functions, i.e. ${.PVC.labels.team | default "shared" | lower}.
+// Keys without a value are an error, unless a default is given.
+type pathTemplate struct {
+	pvc              *v1.PersistentVolumeClaim
+	pvName           string
+	storageClassName string
+
+	// the namespace is only loaded when the pattern references it
+	namespace *v1.Namespace
+}
+
+// pathTemplateFuncs transform a value, arg is empty for functions without an argument
+var pathTemplateFuncs = map[string]func(value string, arg string, ok bool) (string, bool, error){
+	"default": func(value string, arg string, ok bool) (string, bool, error) {
+		if !ok || value == "" {
+			return arg, true, nil
+		}
+		return value, ok, nil
+	},
+	"lower": func(value string, arg string, ok bool) (string, bool, error) {
+		return strings.ToLower(value), ok, nil
+	},
+	"upper": func(value string, arg string, ok bool) (string, bool, error) {
+		return strings.ToUpper(value), ok, nil
+	},
+	"sanitize": func(value string, arg string, ok bool) (string, bool, error) {
+		return sanitizePattern.ReplaceAllString(value, "-"), ok, nil
+	},
+	"trunc": func(value string, arg string, ok bool) (string, bool, error) {
+		n, err := strconv.Atoi(arg)
+		if err != nil || n < 0 {
+			return "", false, fmt.Errorf("trunc needs a length, got %q", arg)
+		}
+		if len(value) > n {
+			value = value[:n]
+		}
+		return value, ok, nil
+	},
+}
+
+// sanitize replaces everything but letters, digits, dots, dashes and underscores
+var sanitizePattern = regexp.MustCompile(`[^A-Za-z0-9._-]`)
+
+// render replaces the ${...} expressions of the pattern
+func (t *pathTemplate) render(pattern string) (string, error) {
+	var result strings.Builder
+
+	for {
+		start := strings.Index(pattern, "${")
+		if start < 0 {
+			result.WriteString(pattern)
+			return result.String(), nil
+		}
+		result.WriteString(pattern[:start])
+
+		end := expressionEnd(pattern, start+2)
+		if end < 0 {
+			return "", status.Errorf(codes.InvalidArgument, "pathPattern %q has an unterminated ${", pattern)
+		}
+
+		value, err := t.evaluate(pattern[start+2 : end])
+		if err != nil {
+			return "", status.Errorf(codes.InvalidArgument, "pathPattern expression ${%s}: %s", pattern[start+2:end], err)
+		}
+		result.WriteString(value)
+
+		pattern = pattern[end+1:]
+	}
+}
+
+// expressionEnd returns the index of the } closing the expression, skipping quoted arguments
+func expressionEnd(pattern string, from int) int {
+	quoted := false
+	for i := from; i < len(pattern); i++ {
+		switch {
+		case pattern[i] == '\\' && quoted:
+			i++
+		case pattern[i] == '"':
+			quoted = !quoted
+		case pattern[i] == '}' && !quoted:
+			return i
+		}
+	}
+	return -1
+}
+
+func (t *pathTemplate) evaluate(expression string) (string, error) {
+	stages := splitPipeline(expression)
+
+	key := strings.TrimSpace(stages[0])
+	value, ok, err := t.lookup(key)
+	if err != nil {
+		return "", err
+	}
+
+	for _, stage := range stages[1:] {
+		stage = strings.TrimSpace(stage)
+		name, arg := stage, ""
+		if i := strings.IndexAny(stage, " \t"); i >= 0 {
+			name, arg = stage[:i], strings.TrimSpace(stage[i+1:])
+		}
+		if strings.HasPrefix(arg, `"`) {
+			if arg, err = strconv.Unquote(arg); err != nil {
+				return "", fmt.Errorf("invalid argument of %s: %v", name, err)
+			}
+		}
+
+		fn, found := pathTemplateFuncs[name]
+		if !found {
+			return "", fmt.Errorf("unknown function %q", name)
+		}
+		if value, ok, err = fn(value, arg, ok); err != nil {
+			return "", err
+		}
+	}
+
+	// An empty value would put the volume into the parent path shared with other volumes
+	if !ok || value == "" {
+		return "", fmt.Errorf("%s has no value, set it or add a default", key)
+	}
+
+	return value, nil
+}
+
+// splitPipeline splits the expression on | outside of quoted arguments
+func splitPipeline(expression string) []string {
+	stages := []string{}
+	quoted := false
+	last := 0
+	for i := 0; i < len(expression); i++ {
+		switch {
+		case expression[i] == '\\' && quoted:
+			i++
+		case expression[i] == '"':
+			quoted = !quoted
+		case expression[i] == '|' && !quoted:
+			stages = append(stages, expression[last:i])
+			last = i + 1
+		}
+	}
+	return append(stages, expression[last:])
+}
+
+// lookup returns the value of a key and whether it is set
+func (t *pathTemplate) lookup(key string) (string, bool, error) {
+	parts := strings.SplitN(strings.TrimPrefix(key, "."), ".", 3)
+	if !strings.HasPrefix(key, ".") || len(parts) < 2 {
+		return "", false, fmt.Errorf("unknown key %q", key)
+	}
+
+	switch parts[0] {
+	case "PVC":
+		switch {
+		case len(parts) == 2 && parts[1] == "name":
+			return t.pvc.Name, true, nil
+		case len(parts) == 2 && parts[1] == "namespace":
+			return t.pvc.Namespace, true, nil
+		case len(parts) == 2 && parts[1] == "uid":
+			return string(t.pvc.UID), t.pvc.UID != "", nil
+		case len(parts) == 3 && parts[1] == "labels":
+			value, ok := t.pvc.Labels[parts[2]]
+			return value, ok, nil
+		case len(parts) == 3 && parts[1] == "annotations":
+			value, ok := t.pvc.Annotations[parts[2]]
+			return value, ok, nil
+		}
+	case "PV":
+		if len(parts) == 2 && parts[1] == "name" {
+			return t.pvName, t.pvName != "", nil
+		}
+	case "StorageClass":
+		if len(parts) == 2 && parts[1] == "name" {
+			return t.storageClassName, t.storageClassName != "", nil
+		}
+	case "Namespace":
+		if len(parts) == 3 && (parts[1] == "labels" || parts[1] == "annotations") {
+			namespace, err := t.getNamespace()
+			if err != nil {
+				return "", false, err
+			}
+			values := namespace.Labels
+			if parts[1] == "annotations" {
+				values = namespace.Annotations
+			}
+			value, ok := values[parts[2]]
+			return value, ok, nil
+		}
+	}
+
+	return "", false, fmt.Errorf("unknown key %q", key)
+}
+
+func (t *pathTemplate) getNamespace() (*v1.Namespace, error) {
+	if t.namespace != nil {
+		return t.namespace, nil
+	}
+
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return nil, fmt.Errorf("can not create kubernetes client: %s", e)
+	}
+
+	namespace, err := clientset.CoreV1().Namespaces().Get(t.pvc.Namespace, metav1.GetOptions{})
+	if err != nil {
+		return nil, fmt.Errorf("can not load namespace %s: %s", t.pvc.Namespace, err)
+	}
+	t.namespace = namespace
+
+	return namespace, nil
+}
+
+// Characters allowed in the segments of a rendered pathPattern, rclone remotes interpret others
+// (i.e. ":" starts an on the fly remote, "\" separates paths on some backends)
+var pathSegmentPattern = regexp.MustCompile(`^[A-Za-z0-9._@+=,-]+$`)
+
+// normalizePathSuffix cleans a rendered pathPattern and rejects paths escaping remotePath
+func normalizePathSuffix(suffix string) (string, error) {
+	segments := []string{}
+	for _, segment := range strings.Split(suffix, "/") {
+		switch segment {
+		case "", ".":
+			// "a//b" and "a/./b" are "a/b", a leading "/" stays relative to remotePath
+			continue
+		case "..":
+			return "", status.Errorf(codes.InvalidArgument, "pathPattern resolves to %q, .. is not allowed", suffix)
+		case reservedDir:
+			// Archives and snapshots of all volumes are stored there
+			return "", status.Errorf(codes.InvalidArgument, "pathPattern resolves to %q, %s is reserved", suffix, reservedDir)
+		}
+		if !pathSegmentPattern.MatchString(segment) {
+			return "", status.Errorf(codes.InvalidArgument, "pathPattern resolves to %q, only letters, digits and ._@+=,- are allowed", suffix)
+		}
+		segments = append(segments, segment)
+	}
+
+	// An empty path would give the volume the shared remotePath
+	if len(segments) == 0 {
+		return "", status.Errorf(codes.InvalidArgument, "pathPattern resolves to the empty path %q", suffix)
+	}
+
+	return "/" + strings.Join(segments, "/"), nil
+}
+
+// findPathOwner returns the name of a live PersistentVolume using the same remote path as the volume,
+// or a path inside of it or containing it. Volumes are compared by their volumeAttributes, remotes set
+// in secrets are assumed to be the same.
+func findPathOwner(volumeName string, volumeContext map[string]string) (string, error) {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return "", status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+
+	pvs, err := clientset.CoreV1().PersistentVolumes().List(metav1.ListOptions{})
+	if err != nil {
+		return "", status.Errorf(codes.Internal, "can not list PVs: %s", err)
+	}
+
+	path := volumeContext["remotePath"] + volumeContext["remotePathSuffix"] + "/"
+	for _, pv := range pvs.Items {
+		csiSource := pv.Spec.CSI
+		if csiSource == nil || csiSource.Driver != DriverName || csiSource.VolumeHandle == volumeName {
+			continue
+		}
+		// Released volumes have lost their claim, their path may be reused with allowExisting
+		if pv.DeletionTimestamp != nil || pv.Status.Phase == v1.VolumeReleased || pv.Status.Phase == v1.VolumeFailed {
+			continue
+		}
+
+		attributes := csiSource.VolumeAttributes
+		if attributes["remote"] != volumeContext["remote"] {
+			continue
+		}
+		otherPath := attributes["remotePath"] + attributes["remotePathSuffix"] + "/"
+		if strings.HasPrefix(path, otherPath) || strings.HasPrefix(otherPath, path) {
+			return pv.Name, nil
+		}
+	}
+
+	return "", nil
+}
@@ -0,0 +1,114 @@
+package rclone
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPathTemplateRender(t *testing.T) {
+	template := &pathTemplate{
+		pvc: &v1.PersistentVolumeClaim{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "data",
+				Namespace:   "team-a",
+				UID:         "1234-5678",
+				Labels:      map[string]string{"team": "Analytics", "empty": ""},
+				Annotations: map[string]string{"example.com/project": "Reports 2024"},
+			},
+		},
+		pvName:           "pvc-1234",
+		storageClassName: "rclone",
+		namespace: &v1.Namespace{
+			ObjectMeta: metav1.ObjectMeta{
+				Name:        "team-a",
+				Labels:      map[string]string{"tenant": "acme"},
+				Annotations: map[string]string{"cost-center": "42"},
+			},
+		},
+	}
+
+	tests := []struct {
+		pattern string
+		want    string
+		code    codes.Code
+	}{
+		{"static/path", "static/path", codes.OK},
+		{"${.PVC.namespace}/${.PVC.name}", "team-a/data", codes.OK},
+		{"${.PVC.uid}-${.PV.name}-${.StorageClass.name}", "1234-5678-pvc-1234-rclone", codes.OK},
+		{"${ .PVC.labels.team }", "Analytics", codes.OK},
+		{"${.PVC.labels.team | lower}", "analytics", codes.OK},
+		{"${.PVC.labels.team | upper}", "ANALYTICS", codes.OK},
+		{"${.PVC.labels.team | trunc 4}", "Anal", codes.OK},
+		{"${.PVC.annotations.example.com/project | sanitize}", "Reports-2024", codes.OK},
+		{"${.PVC.labels.missing | default \"shared\"}", "shared", codes.OK},
+		{"${.PVC.labels.empty | default shared}", "shared", codes.OK},
+		{"${.PVC.labels.missing | default \"a|b}\"}", "a|b}", codes.OK},
+		{"${.PVC.labels.missing | default \"Shared Data\" | sanitize | lower}", "shared-data", codes.OK},
+		{"${.Namespace.labels.tenant}/${.Namespace.annotations.cost-center}", "acme/42", codes.OK},
+		{"${.PVC.labels.missing}", "", codes.InvalidArgument},
+		{"${.PVC.labels.empty}", "", codes.InvalidArgument},
+		{"${.PVC.labels.missing | default \"\"}", "", codes.InvalidArgument},
+		{"${.PVC.name", "", codes.InvalidArgument},
+		{"${.PVC.size}", "", codes.InvalidArgument},
+		{"${PVC.name}", "", codes.InvalidArgument},
+		{"${.Node.name}", "", codes.InvalidArgument},
+		{"${.PVC.name | reverse}", "", codes.InvalidArgument},
+		{"${.PVC.name | trunc}", "", codes.InvalidArgument},
+		{"${.PVC.name | trunc -1}", "", codes.InvalidArgument},
+		{"${.PVC.name | default \"unterminated}", "", codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		got, err := template.render(test.pattern)
+		if code := status.Code(err); code != test.code {
+			t.Errorf("render(%q) = %v, want code %v", test.pattern, err, test.code)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("render(%q) = %q, want %q", test.pattern, got, test.want)
+		}
+	}
+}
+
+func TestNormalizePathSuffix(t *testing.T) {
+	tests := []struct {
+		suffix string
+		want   string
+		code   codes.Code
+	}{
+		{"team-a/data", "/team-a/data", codes.OK},
+		{"/team-a/data/", "/team-a/data", codes.OK},
+		{"team-a//./data", "/team-a/data", codes.OK},
+		{"user@example.com/a+b=c,d_e.f", "/user@example.com/a+b=c,d_e.f", codes.OK},
+		{"..data/v1.2", "/..data/v1.2", codes.OK},
+		{".csi-rclone-data", "/.csi-rclone-data", codes.OK},
+		{"", "", codes.InvalidArgument},
+		{"/./", "", codes.InvalidArgument},
+		{"..", "", codes.InvalidArgument},
+		{"team-a/../team-b", "", codes.InvalidArgument},
+		{"team-a/..", "", codes.InvalidArgument},
+		{".csi-rclone", "", codes.InvalidArgument},
+		{"team-a/.csi-rclone/snapshots", "", codes.InvalidArgument},
+		{"team a", "", codes.InvalidArgument},
+		{":s3:bucket", "", codes.InvalidArgument},
+		{"team-a\\data", "", codes.InvalidArgument},
+		{"team-a/dätä", "", codes.InvalidArgument},
+		{"team-a/data*", "", codes.InvalidArgument},
+		{"team-a/\x00", "", codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		got, err := normalizePathSuffix(test.suffix)
+		if code := status.Code(err); code != test.code {
+			t.Errorf("normalizePathSuffix(%q) = %v, want code %v", test.suffix, err, test.code)
+			continue
+		}
+		if got != test.want {
+			t.Errorf("normalizePathSuffix(%q) = %q, want %q", test.suffix, got, test.want)
+		}
+	}
+}
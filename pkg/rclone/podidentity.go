@@ -0,0 +1,79 @@
+package rclone
+
+import (
+	"strings"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Volume context key of volumes mounted with the credentials of the pod service account, not an rclone flag
+const podIdentityParameter = "podIdentity"
+
+// Secrets with this annotation hold the backend credentials of the service account named by its value
+const serviceAccountSecretAnnotation = "csi-rclone/for-serviceaccount"
+
+// isPodIdentity returns whether every pod gets its own mount with the credentials of its service account
+func isPodIdentity(volumeContext map[string]string) bool {
+	return volumeContext[podIdentityParameter] == "true"
+}
+
+// mountsPerPod returns whether the volume is mounted per pod on publish instead of shared by the pods of
+// the node, because its credentials depend on the pod
+func mountsPerPod(volumeContext map[string]string) bool {
+	return isPodIdentity(volumeContext) || usesServiceAccountToken(volumeContext)
+}
+
+// getPodIdentitySecrets returns the credentials of the pod service account, from the secret of the pod
+// namespace annotated with csi-rclone/for-serviceaccount: <service account>. The secret is created by
+// users, it can only hold backend credentials and flags, not the remote or node settings.
+func getPodIdentitySecrets(volumeContext map[string]string) (map[string]string, error) {
+	// provided by kubelet on publish since CSIDriver sets podInfoOnMount
+	namespace := volumeContext["csi.storage.k8s.io/pod.namespace"]
+	serviceAccount := volumeContext["csi.storage.k8s.io/serviceAccount.name"]
+	if namespace == "" || serviceAccount == "" {
+		return nil, status.Error(codes.InvalidArgument, "podIdentity volumes need the pod info of podInfoOnMount, they can not be staged")
+	}
+
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+
+	secrets, err := clientset.CoreV1().Secrets(namespace).List(metav1.ListOptions{})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can not list secrets of namespace %s: %s", namespace, err)
+	}
+
+	names := []string{}
+	flags := map[string]string{}
+	for _, secret := range secrets.Items {
+		if secret.Annotations[serviceAccountSecretAnnotation] != serviceAccount {
+			continue
+		}
+		names = append(names, secret.Name)
+		for k, v := range secret.Data {
+			flags[k] = string(v)
+		}
+	}
+
+	switch len(names) {
+	case 0:
+		return nil, status.Errorf(codes.PermissionDenied, "no secret with annotation %s: %s in namespace %s", serviceAccountSecretAnnotation, serviceAccount, namespace)
+	case 1:
+	default:
+		return nil, status.Errorf(codes.FailedPrecondition, "secrets %s of namespace %s are all annotated %s: %s", strings.Join(names, ", "), namespace, serviceAccountSecretAnnotation, serviceAccount)
+	}
+
+	for key := range flags {
+		if reservedAnnotationFlags[key] || isNodeCredentialFlag(key) || strings.HasPrefix(key, "csi.storage.k8s.io/") {
+			return nil, status.Errorf(codes.InvalidArgument, "secret %s/%s of service account %s can not set %s", namespace, names[0], serviceAccount, key)
+		}
+	}
+
+	glog.V(4).Infof("Using secret %s/%s of service account %s", namespace, names[0], serviceAccount)
+
+	return flags, nil
+}
@@ -0,0 +1,206 @@
+package rclone
+
+import (
+	"time"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+const (
+	// Populate records are ConfigMaps in the plugin namespace, they exist from the start of the copy
+	// into a restored or cloned volume until the volume is deleted, the copy failed for good or its
+	// PVC was deleted before the volume was provisioned
+	populateRecordPrefix = "csi-rclone-populate-"
+	populateRecordLabel  = "csi-rclone/populate"
+	populateRecordKey    = "populate"
+
+	// copyTimeout bounds the background copies of snapshots and populated volumes
+	copyTimeout = 24 * time.Hour
+
+	// maxPopulateFailures failed copies make provisioning fail, the next attempt starts over
+	maxPopulateFailures = 3
+	// claimCheckInterval is how often a running copy checks that its PVC still exists
+	claimCheckInterval = time.Minute
+)
+
+// populateRecord tracks the copy of the content source into a volume, the volume is provisioned once
+// the copy is done. A controller restarted during the copy starts it again, rclone skips the files
+// already copied.
+type populateRecord struct {
+	VolumeID string `json:"volumeId"`
+	// PVC the volume is provisioned for, the record is dropped when it is deleted before the copy has finished
+	PVCName      string `json:"pvcName,omitempty"`
+	PVCNamespace string `json:"pvcNamespace,omitempty"`
+	Done         bool   `json:"done,omitempty"`
+	// Error of the last failed copy and the number of failed copies
+	Error    string `json:"error,omitempty"`
+	Failures int    `json:"failures,omitempty"`
+}
+
+func populateRecordName(volumeID string) string {
+	return populateRecordPrefix + volumeID
+}
+
+// getPopulateRecord loads the populate record of a volume, nil if the copy was never started
+func getPopulateRecord(volumeID string) (*populateRecord, error) {
+	var record populateRecord
+	found, err := getRecord(populateRecordName(volumeID), populateRecordKey, &record)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func deletePopulateRecord(volumeID string) error {
+	return deleteRecord(populateRecordName(volumeID))
+}
+
+// claimExists returns whether the PVC still exists, records without PVC are always kept
+func claimExists(name string, namespace string) (bool, error) {
+	if name == "" {
+		return true, nil
+	}
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return false, status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+
+	_, err := clientset.CoreV1().PersistentVolumeClaims(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "can not load PVC %s/%s: %s", namespace, name, err)
+	}
+	return true, nil
+}
+
+// sweepPopulateRecords deletes the records of copies that stopped with the controller and whose PVC was
+// deleted meanwhile, the provisioner does not call DeleteVolume for volumes it never got
+func (cs *controllerServer) sweepPopulateRecords() {
+	configMaps, err := listRecords(populateRecordLabel)
+	if err != nil {
+		glog.Warningf("Cannot list populate records: %v", err)
+		return
+	}
+
+	for i := range configMaps {
+		var record populateRecord
+		if err := parseRecord(&configMaps[i], populateRecordKey, &record); err != nil {
+			glog.Warningf("Skipping populate record: %v", err)
+			continue
+		}
+		if record.Done || !cs.startOperation(record.VolumeID) {
+			continue
+		}
+		if exists, err := claimExists(record.PVCName, record.PVCNamespace); err != nil {
+			glog.Warningf("Cannot check PVC of populate record %s: %v", configMaps[i].Name, err)
+		} else if !exists {
+			glog.Infof("Deleting populate record of volume %s, PVC %s/%s is gone", record.VolumeID, record.PVCNamespace, record.PVCName)
+			if err := deletePopulateRecord(record.VolumeID); err != nil {
+				glog.Warningf("Cannot delete populate record of volume %s: %v", record.VolumeID, err)
+			}
+		}
+		cs.finishOperation(record.VolumeID)
+	}
+}
+
+// watchClaim stops the copy into a volume when its PVC is deleted, until ctx is done
+func (cs *controllerServer) watchClaim(ctx context.Context, volumeName string, pvcName string, pvcNamespace string) {
+	ticker := time.NewTicker(claimCheckInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			if exists, err := claimExists(pvcName, pvcNamespace); err == nil && !exists {
+				glog.Infof("PVC %s/%s was deleted, stopping to populate volume %s", pvcNamespace, pvcName, volumeName)
+				cs.cancelOperation(volumeName)
+				return
+			}
+		}
+	}
+}
+
+// populateVolume copies the content source into the volume in the background. It returns Aborted, which
+// makes the provisioner retry, until the copy has finished. Copies failing maxPopulateFailures times or
+// running into copyTimeout fail provisioning, the record is deleted and the next attempt starts over.
+func (cs *controllerServer) populateVolume(volumeName string, pvcName string, pvcNamespace string, record *populateRecord, sourceContext map[string]string, sourceSecrets map[string]string, volumeContext map[string]string, secrets map[string]string) error {
+	if record != nil && record.Done {
+		return nil
+	}
+	if record != nil && record.Failures >= maxPopulateFailures {
+		if err := deletePopulateRecord(volumeName); err != nil {
+			return err
+		}
+		return status.Errorf(codes.Internal, "failed to populate volume %s: %s", volumeName, record.Error)
+	}
+
+	volumeCopy, err := cs.prepareVolumeCopy(volumeName, sourceContext, sourceSecrets, volumeContext, secrets)
+	if err != nil {
+		// The copy can not be started with these settings, retrying would not help
+		if record != nil {
+			if e := deletePopulateRecord(volumeName); e != nil {
+				return e
+			}
+		}
+		return err
+	}
+
+	if record == nil {
+		record = &populateRecord{VolumeID: volumeName, PVCName: pvcName, PVCNamespace: pvcNamespace}
+		if err := createRecord(populateRecordName(volumeName), populateRecordLabel, populateRecordKey, record); err != nil {
+			if status.Code(err) == codes.AlreadyExists {
+				return status.Errorf(codes.Aborted, "volume %s is already being populated", volumeName)
+			}
+			return err
+		}
+	}
+
+	if ctx, ok := cs.startBackgroundOperation(volumeName); ok {
+		go func() {
+			defer cs.finishOperation(volumeName)
+			go cs.watchClaim(ctx, volumeName, record.PVCName, record.PVCNamespace)
+
+			glog.Infof("Populating volume %s: copying %s to %s", volumeName, volumeCopy.source, volumeCopy.destination)
+			update := *record
+			update.Done, update.Error = true, ""
+			if _, err := RcloneCommand(ctx, volumeCopy.configData, volumeCopy.flags, "copy", volumeCopy.source, volumeCopy.destination, "--create-empty-src-dirs"); err != nil {
+				glog.Errorf("Failed to copy %s to %s: %v", volumeCopy.source, volumeCopy.destination, err)
+				update.Done, update.Error = false, err.Error()
+				update.Failures++
+				// A copy stopped by copyTimeout would run into it again
+				if ctx.Err() == context.DeadlineExceeded {
+					update.Failures = maxPopulateFailures
+				}
+			} else {
+				glog.Infof("Volume %s is populated", volumeName)
+			}
+
+			// Nobody waits for the volume of a deleted PVC
+			if exists, err := claimExists(record.PVCName, record.PVCNamespace); err == nil && !exists {
+				glog.Infof("Deleting populate record of volume %s, PVC %s/%s is gone", volumeName, record.PVCNamespace, record.PVCName)
+				if err := deletePopulateRecord(volumeName); err != nil {
+					glog.Errorf("Cannot delete populate record of volume %s: %v", volumeName, err)
+				}
+				return
+			}
+
+			// A volume deleted meanwhile has no record anymore, it is not created again
+			if err := updateRecord(populateRecordName(volumeName), populateRecordKey, &update); err != nil {
+				glog.Errorf("Cannot update populate record of volume %s: %v", volumeName, err)
+			}
+		}()
+	}
+
+	if record.Error != "" {
+		return status.Errorf(codes.Aborted, "failed to populate volume %s, retrying: %s", volumeName, record.Error)
+	}
+	return status.Errorf(codes.Aborted, "volume %s is being populated", volumeName)
+}
@@ -0,0 +1,267 @@
+package rclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"sync/atomic"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Volume context keys of the volume capacity, they are not rclone flags
+const (
+	capacityParameter     = "capacityBytes"
+	enforceQuotaParameter = "enforceQuota"
+)
+
+// https://rclone.org/rc/#operations-size
+type rcOperationsSizeResponse struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+// https://rclone.org/rc/#running-asynchronous-jobs-with-async-true
+type rcAsyncResponse struct {
+	JobID int64 `json:"jobid"`
+}
+
+// https://rclone.org/rc/#job-status
+type rcJobStatusResponse struct {
+	Finished bool                     `json:"finished"`
+	Success  bool                     `json:"success"`
+	Error    string                   `json:"error"`
+	Output   rcOperationsSizeResponse `json:"output"`
+}
+
+// quotaScanTimeout bounds the usage scan of a volume, listing big volumes takes longer than rcTimeout
+const quotaScanTimeout = 1 * time.Hour
+
+// parseCapacity reads the volume capacity and quota enforcement from the volume context
+func parseCapacity(volumeContext map[string]string) (int64, bool, error) {
+	capacity := int64(0)
+	if val := volumeContext[capacityParameter]; val != "" {
+		var err error
+		if capacity, err = strconv.ParseInt(val, 10, 64); err != nil || capacity < 0 {
+			return 0, false, status.Errorf(codes.InvalidArgument, "invalid %s %q", capacityParameter, val)
+		}
+	}
+
+	enforceQuota := false
+	if val := volumeContext[enforceQuotaParameter]; val != "" {
+		var err error
+		if enforceQuota, err = strconv.ParseBool(val); err != nil {
+			return 0, false, status.Errorf(codes.InvalidArgument, "invalid %s parameter %q: %s", enforceQuotaParameter, val, err)
+		}
+	}
+	if enforceQuota && capacity == 0 {
+		return 0, false, status.Errorf(codes.InvalidArgument, "%s requires a volume capacity", enforceQuotaParameter)
+	}
+
+	return capacity, enforceQuota, nil
+}
+
+// applyCapacityFlags limits the VFS cache to the volume capacity and reports it as the size of the mount,
+// flags set explicitly for the volume are kept
+func applyCapacityFlags(flags map[string]string, capacity int64) {
+	if capacity <= 0 {
+		return
+	}
+
+	// rclone sizes without suffix are KiB
+	size := fmt.Sprintf("%dB", capacity)
+	if _, ok := flags["vfs-cache-max-size"]; !ok {
+		flags["vfs-cache-max-size"] = size
+	}
+	if _, ok := flags["vfs-disk-space-total-size"]; !ok {
+		flags["vfs-disk-space-total-size"] = size
+	}
+}
+
+// updateCapacityFlags replaces the capacity flags set by applyCapacityFlags with the expanded capacity
+func updateCapacityFlags(flags map[string]string, oldCapacity int64, newCapacity int64) {
+	oldSize := fmt.Sprintf("%dB", oldCapacity)
+	newSize := fmt.Sprintf("%dB", newCapacity)
+	for _, flag := range []string{"vfs-cache-max-size", "vfs-disk-space-total-size"} {
+		if flags[flag] == oldSize {
+			flags[flag] = newSize
+		}
+	}
+}
+
+// expandedCapacity returns the capacity of the PersistentVolume if it was expanded after provisioning,
+// the volume context keeps the provisioned capacity
+func expandedCapacity(volumeID string, capacity int64) int64 {
+	pv, err := getPersistentVolume(volumeID)
+	if err != nil || pv == nil {
+		glog.V(4).Infof("No PV found for volume %s, using provisioned capacity", volumeID)
+		return capacity
+	}
+
+	if storage, ok := pv.Spec.Capacity[v1.ResourceStorage]; ok && storage.Value() > capacity {
+		return storage.Value()
+	}
+
+	return capacity
+}
+
+// runQuotaChecks periodically scans the usage of volumes with enforceQuota
+func (ns *nodeServer) runQuotaChecks(interval time.Duration) {
+	glog.Infof("Checking volume quotas every %s", interval)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		for _, mc := range ns.listMountContexts() {
+			// Read-only mounts can not exceed the quota, a restored quota must not make them writable
+			if !mc.EnforceQuota || mc.CapacityBytes <= 0 || mc.ReadOnly {
+				continue
+			}
+			// Scans of big volumes may take longer than the interval
+			if !atomic.CompareAndSwapInt32(&mc.checkingQuota, 0, 1) {
+				continue
+			}
+			go func(mc *mountContext) {
+				defer atomic.StoreInt32(&mc.checkingQuota, 0)
+				ns.checkQuota(mc)
+			}(mc)
+		}
+	}
+}
+
+// checkQuota makes the mount read-only while the volume uses more than its capacity
+func (ns *nodeServer) checkQuota(mc *mountContext) {
+	// The scan lists the whole volume, it runs without holding the mount
+	used, err := getRemoteSize(mc.RcAddr, mc.Remote)
+	if err != nil {
+		glog.Warningf("Cannot get usage of volume %s: %v", mc.VolumeID, err)
+		return
+	}
+
+	mc.mu.Lock()
+	defer mc.mu.Unlock()
+
+	if !ns.hasMountContext(mc) {
+		return
+	}
+
+	overQuota := used > mc.CapacityBytes
+	// Mounts made read-only by the volume flags are left alone
+	if !overQuota && !mc.OverQuota {
+		return
+	}
+
+	// Applied on every check while over quota, a remounted volume is read-write again
+	if err := setMountReadOnly(mc.TargetPath, overQuota); err != nil {
+		glog.Errorf("Cannot change read-only state of volume %s at %s: %v", mc.VolumeID, mc.TargetPath, err)
+		return
+	}
+
+	if overQuota == mc.OverQuota {
+		return
+	}
+	mc.OverQuota = overQuota
+	ns.setMountContext(mc.TargetPath, mc)
+
+	if overQuota {
+		glog.Warningf("Volume %s uses %d of %d bytes, mount at %s is read-only", mc.VolumeID, used, mc.CapacityBytes, mc.TargetPath)
+		ns.recordMountEvent(mc, v1.EventTypeWarning, "QuotaExceeded",
+			fmt.Sprintf("volume %s uses %d bytes of its %d bytes capacity, writes are rejected until data is removed", mc.VolumeID, used, mc.CapacityBytes))
+	} else {
+		glog.Infof("Volume %s uses %d of %d bytes, mount at %s is writable again", mc.VolumeID, used, mc.CapacityBytes, mc.TargetPath)
+		ns.recordMountEvent(mc, v1.EventTypeNormal, "QuotaRestored",
+			fmt.Sprintf("volume %s uses %d bytes of its %d bytes capacity, writes are accepted again", mc.VolumeID, used, mc.CapacityBytes))
+	}
+}
+
+// getRemoteSize asks the mount's rc server for the size of the volume remote path
+func getRemoteSize(rcAddr string, remote string) (int64, error) {
+	if rcAddr == "" {
+		return 0, fmt.Errorf("no rclone process is tracked")
+	}
+
+	input, err := json.Marshal(map[string]interface{}{"fs": remote, "_async": true})
+	if err != nil {
+		return 0, err
+	}
+
+	out, err := RcloneRPC(rcAddr, "operations/size", string(input))
+	if err != nil {
+		return 0, err
+	}
+
+	var job rcAsyncResponse
+	if err := json.Unmarshal([]byte(out), &job); err != nil {
+		return 0, fmt.Errorf("cannot parse operations/size response: %v", err)
+	}
+
+	timeout := time.Now().Add(quotaScanTimeout)
+	for timeout.After(time.Now()) {
+		time.Sleep(5 * time.Second)
+
+		out, err := RcloneRPC(rcAddr, "job/status", fmt.Sprintf(`{"jobid": %d}`, job.JobID))
+		if err != nil {
+			return 0, err
+		}
+
+		var jobStatus rcJobStatusResponse
+		if err := json.Unmarshal([]byte(out), &jobStatus); err != nil {
+			return 0, fmt.Errorf("cannot parse job/status response: %v", err)
+		}
+		if !jobStatus.Finished {
+			continue
+		}
+		if !jobStatus.Success {
+			return 0, fmt.Errorf("operations/size failed: %s", jobStatus.Error)
+		}
+
+		return jobStatus.Output.Bytes, nil
+	}
+
+	RcloneRPC(rcAddr, "job/stop", fmt.Sprintf(`{"jobid": %d}`, job.JobID))
+	return 0, fmt.Errorf("operations/size did not finish within %s", quotaScanTimeout)
+}
+
+// Per-mount options and their mount flags, a remount without them clears them
+var remountOptionFlags = map[string]uintptr{
+	"nosuid":      syscall.MS_NOSUID,
+	"nodev":       syscall.MS_NODEV,
+	"noexec":      syscall.MS_NOEXEC,
+	"noatime":     syscall.MS_NOATIME,
+	"nodiratime":  syscall.MS_NODIRATIME,
+	"relatime":    syscall.MS_RELATIME,
+	"strictatime": syscall.MS_STRICTATIME,
+}
+
+// setMountReadOnly remounts the FUSE superblock, so bind mounts of a staged volume follow.
+// The other options of the mount (i.e. nosuid, nodev) are kept.
+func setMountReadOnly(targetPath string, readOnly bool) error {
+	mountOptions, err := getMountOptions()
+	if err != nil {
+		return fmt.Errorf("cannot read mount options: %v", err)
+	}
+	options, ok := mountOptions[targetPath]
+	if !ok {
+		return fmt.Errorf("%s is not mounted", targetPath)
+	}
+
+	return syscall.Mount("", targetPath, "", remountFlags(options, readOnly), "")
+}
+
+// remountFlags returns the flags remounting a mount with options read-only or read-write
+func remountFlags(options []string, readOnly bool) uintptr {
+	flags := uintptr(syscall.MS_REMOUNT)
+	for _, option := range options {
+		flags |= remountOptionFlags[option]
+	}
+	if readOnly {
+		flags |= syscall.MS_RDONLY
+	}
+	return flags
+}
@@ -0,0 +1,26 @@
+package rclone
+
+import (
+	"syscall"
+	"testing"
+)
+
+func TestRemountFlags(t *testing.T) {
+	tests := []struct {
+		options  []string
+		readOnly bool
+		want     uintptr
+	}{
+		{[]string{"rw"}, true, syscall.MS_REMOUNT | syscall.MS_RDONLY},
+		{[]string{"ro"}, false, syscall.MS_REMOUNT},
+		{[]string{"rw", "nosuid", "nodev", "relatime"}, true, syscall.MS_REMOUNT | syscall.MS_RDONLY | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_RELATIME},
+		{[]string{"ro", "nosuid", "nodev", "noexec"}, false, syscall.MS_REMOUNT | syscall.MS_NOSUID | syscall.MS_NODEV | syscall.MS_NOEXEC},
+		{[]string{"rw", "noatime", "nodiratime"}, false, syscall.MS_REMOUNT | syscall.MS_NOATIME | syscall.MS_NODIRATIME},
+	}
+
+	for _, test := range tests {
+		if got := remountFlags(test.options, test.readOnly); got != test.want {
+			t.Errorf("remountFlags(%v, %v) = %#x, want %#x", test.options, test.readOnly, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,158 @@
+package rclone
+
+import (
+	"encoding/json"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Records are ConfigMaps in the plugin namespace holding a JSON value under key, the controller keeps
+// what it knows about snapshots and running copies in them so it survives controller restarts
+
+// getRecord loads the record name into value, it returns false if the record does not exist
+func getRecord(name string, key string, value interface{}) (bool, error) {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return false, status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+	namespace, err := getDriverNamespace()
+	if err != nil {
+		return false, err
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return false, nil
+	}
+	if err != nil {
+		return false, status.Errorf(codes.Internal, "can not load record %s: %s", name, err)
+	}
+
+	if err := parseRecord(configMap, key, value); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+func parseRecord(configMap *v1.ConfigMap, key string, value interface{}) error {
+	if err := json.Unmarshal([]byte(configMap.Data[key]), value); err != nil {
+		return status.Errorf(codes.Internal, "can not parse record %s: %s", configMap.Name, err)
+	}
+	return nil
+}
+
+// createRecord saves a new record labeled with label, it fails with AlreadyExists if the record exists
+func createRecord(name string, label string, key string, value interface{}) error {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+	namespace, err := getDriverNamespace()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	configMap := &v1.ConfigMap{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/managed-by": DriverName,
+				label:                          "true",
+			},
+		},
+		Data: map[string]string{
+			key: string(data),
+		},
+	}
+
+	_, err = clientset.CoreV1().ConfigMaps(namespace).Create(configMap)
+	if apierrors.IsAlreadyExists(err) {
+		return status.Errorf(codes.AlreadyExists, "record %s already exists", name)
+	}
+	if err != nil {
+		return status.Errorf(codes.Internal, "can not save record %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// updateRecord replaces the value of an existing record, a deleted record is not created again
+func updateRecord(name string, key string, value interface{}) error {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+	namespace, err := getDriverNamespace()
+	if err != nil {
+		return err
+	}
+
+	data, err := json.Marshal(value)
+	if err != nil {
+		return status.Error(codes.Internal, err.Error())
+	}
+
+	configMap, err := clientset.CoreV1().ConfigMaps(namespace).Get(name, metav1.GetOptions{})
+	if err != nil {
+		return status.Errorf(codes.Internal, "can not load record %s: %s", name, err)
+	}
+	if configMap.Data == nil {
+		configMap.Data = map[string]string{}
+	}
+	configMap.Data[key] = string(data)
+
+	if _, err := clientset.CoreV1().ConfigMaps(namespace).Update(configMap); err != nil {
+		return status.Errorf(codes.Internal, "can not update record %s: %s", name, err)
+	}
+
+	return nil
+}
+
+func deleteRecord(name string) error {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+	namespace, err := getDriverNamespace()
+	if err != nil {
+		return err
+	}
+
+	err = clientset.CoreV1().ConfigMaps(namespace).Delete(name, &metav1.DeleteOptions{})
+	if err != nil && !apierrors.IsNotFound(err) {
+		return status.Errorf(codes.Internal, "can not delete record %s: %s", name, err)
+	}
+
+	return nil
+}
+
+// listRecords returns the records labeled with label
+func listRecords(label string) ([]v1.ConfigMap, error) {
+	clientset, e := GetK8sClient()
+	if e != nil {
+		return nil, status.Errorf(codes.Internal, "can not create kubernetes client: %s", e)
+	}
+	namespace, err := getDriverNamespace()
+	if err != nil {
+		return nil, err
+	}
+
+	configMaps, err := clientset.CoreV1().ConfigMaps(namespace).List(metav1.ListOptions{
+		LabelSelector: label + "=true",
+	})
+	if err != nil {
+		return nil, status.Errorf(codes.Internal, "can not list records %s: %s", label, err)
+	}
+
+	return configMaps.Items, nil
+}
@@ -0,0 +1,67 @@
+package rclone
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	"github.com/golang/glog"
+	"golang.org/x/net/context"
+)
+
+// rclone exit code for "directory not found", see https://rclone.org/docs/#exit-code
+const rcloneExitDirNotFound = 3
+
+// RcloneCommand runs a one-shot rclone command (mkdir, purge, move, ...) with the given flags
+// passed as environment variables, the same way they are passed to rclone mount
+func RcloneCommand(ctx context.Context, configData string, flags map[string]string, args ...string) (output string, err error) {
+	cmdArgs := append([]string{}, args...)
+
+	// A one-shot command has read the config file before exiting, so it is removed afterwards.
+	// Every command gets its own directory only readable by root, like the config files of mounts.
+	if configData != "" {
+		configDir, err := ioutil.TempDir("", "csi-rclone-config")
+		if err != nil {
+			return "", err
+		}
+		defer removeConfigDir(configDir)
+
+		configFile, err := writeConfigFile(configDir, configData)
+		if err != nil {
+			return "", err
+		}
+
+		cmdArgs = append(cmdArgs, "--config", configFile)
+	} else {
+		// Disable "config not found" notice
+		cmdArgs = append(cmdArgs, "--config=''")
+	}
+
+	env := os.Environ()
+	for k, v := range flags {
+		env = append(env, fmt.Sprintf("%s=%s", flagToEnvName(k), v))
+	}
+
+	glog.V(4).Infof("executing rclone command args: %v", args)
+
+	var stdout, stderr bytes.Buffer
+
+	cmd := exec.CommandContext(ctx, "rclone", cmdArgs...)
+	cmd.Env = env
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+	if err := cmd.Run(); err != nil {
+		return stdout.String(), fmt.Errorf("rclone %v failed: %w output: %q", args, err, stderr.String())
+	}
+
+	return stdout.String(), nil
+}
+
+// isDirNotFound reports whether an rclone command failed because the directory does not exist
+func isDirNotFound(err error) bool {
+	var exitErr *exec.ExitError
+	return errors.As(err, &exitErr) && exitErr.ExitCode() == rcloneExitDirNotFound
+}
@@ -0,0 +1,71 @@
+package rclone
+
+import (
+	"regexp"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+// Backends reading files of the node, directly or through a remote given in their flags (i.e. alias-remote=/etc)
+var nodeFilesystemRemotes = map[string]bool{
+	"local":    true,
+	"alias":    true,
+	"union":    true,
+	"combine":  true,
+	"chunker":  true,
+	"compress": true,
+	"crypt":    true,
+	"hasher":   true,
+	"cache":    true,
+}
+
+// A backend name, connection string parameters (":s3,env_auth=true:") are not allowed
+var backendNamePattern = regexp.MustCompile(`^[a-z0-9]+$`)
+
+// validateVolumeSecrets checks the secrets of a volume whose nodeStageSecretRef or nodePublishSecretRef is
+// in another namespace than the plugin. These secrets are created by the users of that namespace, they
+// must not reach files or credentials of the node.
+func validateVolumeSecrets(volumeID string, secrets map[string]string) error {
+	pv, err := getPersistentVolume(volumeID)
+	if err != nil {
+		return status.Errorf(codes.Internal, "can not load PV of volume %s: %s", volumeID, err)
+	}
+	namespace, err := getDriverNamespace()
+	if err != nil {
+		return err
+	}
+
+	// Secrets of volumes without a PV can not be traced to a namespace
+	if pv != nil && isSecretRefIn(pv.Spec.CSI.NodeStageSecretRef, namespace) && isSecretRefIn(pv.Spec.CSI.NodePublishSecretRef, namespace) {
+		return nil
+	}
+
+	return validateUserSecrets(secrets)
+}
+
+// isSecretRefIn returns whether the secret reference is unset or in namespace
+func isSecretRefIn(ref *v1.SecretReference, namespace string) bool {
+	return ref == nil || ref.Namespace == namespace
+}
+
+// validateUserSecrets refuses volume settings, flags using files, programs or credentials of the node and
+// backends reading files of the node in secrets created by users
+func validateUserSecrets(secrets map[string]string) error {
+	for key := range secrets {
+		if key == "remote" {
+			continue
+		}
+		if reservedAnnotationFlags[key] || strings.HasPrefix(key, "csi.storage.k8s.io/") || isNodeCredentialFlag(key) {
+			return status.Errorf(codes.InvalidArgument, "volume secrets of other namespaces than the plugin can not set %s", key)
+		}
+	}
+
+	if remote, ok := secrets["remote"]; ok && (!backendNamePattern.MatchString(remote) || nodeFilesystemRemotes[remote]) {
+		return status.Errorf(codes.InvalidArgument, "volume secrets of other namespaces than the plugin can not use remote %q", remote)
+	}
+
+	return nil
+}
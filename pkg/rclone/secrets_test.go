@@ -0,0 +1,56 @@
+package rclone
+
+import (
+	"testing"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+func TestValidateUserSecrets(t *testing.T) {
+	tests := []struct {
+		name    string
+		secrets map[string]string
+		want    codes.Code
+	}{
+		{"backend credentials", map[string]string{"remote": "s3", "s3-provider": "Minio", "s3-access-key-id": "id", "s3-secret-access-key": "key"}, codes.OK},
+		{"no remote", map[string]string{"webdav-url": "https://example.com", "webdav-pass": "secret"}, codes.OK},
+		{"configData", map[string]string{"configData": "[local]\ntype = local"}, codes.InvalidArgument},
+		{"remotePath", map[string]string{"remotePath": "other-team"}, codes.InvalidArgument},
+		{"encryption", map[string]string{"encryption": "crypt"}, codes.InvalidArgument},
+		{"kubelet key", map[string]string{"csi.storage.k8s.io/ephemeral": "true"}, codes.InvalidArgument},
+		{"local remote", map[string]string{"remote": "local"}, codes.InvalidArgument},
+		{"alias remote", map[string]string{"remote": "alias", "alias-remote": "/etc"}, codes.InvalidArgument},
+		{"connection string remote", map[string]string{"remote": "s3,env_auth=true"}, codes.InvalidArgument},
+		{"on the fly remote", map[string]string{"remote": ":local:"}, codes.InvalidArgument},
+		{"env auth", map[string]string{"remote": "s3", "s3-env-auth": "true"}, codes.InvalidArgument},
+		{"env auth with underscores", map[string]string{"remote": "s3", "S3_ENV_AUTH": "true"}, codes.InvalidArgument},
+		{"credentials file", map[string]string{"remote": "s3", "s3-shared-credentials-file": "/root/.aws/credentials"}, codes.InvalidArgument},
+		{"cache dir", map[string]string{"remote": "s3", "cache-dir": "/"}, codes.InvalidArgument},
+	}
+
+	for _, test := range tests {
+		err := validateUserSecrets(test.secrets)
+		if got := status.Code(err); got != test.want {
+			t.Errorf("%s: validateUserSecrets(%v) = %v, want code %v", test.name, test.secrets, err, test.want)
+		}
+	}
+}
+
+func TestIsSecretRefIn(t *testing.T) {
+	tests := []struct {
+		ref  *v1.SecretReference
+		want bool
+	}{
+		{nil, true},
+		{&v1.SecretReference{Name: "rclone-secret", Namespace: "csi-rclone"}, true},
+		{&v1.SecretReference{Name: "rclone-secret", Namespace: "team-a"}, false},
+	}
+
+	for _, test := range tests {
+		if got := isSecretRefIn(test.ref, "csi-rclone"); got != test.want {
+			t.Errorf("isSecretRefIn(%v) = %v, want %v", test.ref, got, test.want)
+		}
+	}
+}
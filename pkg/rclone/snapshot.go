@@ -0,0 +1,365 @@
+package rclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"github.com/golang/glog"
+	"github.com/golang/protobuf/ptypes"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	v1 "k8s.io/api/core/v1"
+)
+
+const (
+	// Snapshot records are ConfigMaps in the plugin namespace
+	snapshotRecordPrefix = "csi-rclone-"
+	snapshotRecordLabel  = "csi-rclone/snapshot"
+	snapshotRecordKey    = "snapshot"
+
+	// Snapshots are stored next to the volumes, in <remotePath>/.csi-rclone/snapshots/<snapshot ID>
+	snapshotsDir = reservedDir + "/snapshots"
+)
+
+// snapshotRecord is what the controller knows about a snapshot, the snapshot ID alone does not
+// contain the remote the snapshot is stored on
+type snapshotRecord struct {
+	SnapshotID     string    `json:"snapshotId"`
+	SourceVolumeID string    `json:"sourceVolumeId"`
+	CreationTime   time.Time `json:"creationTime"`
+	SizeBytes      int64     `json:"sizeBytes"`
+	// Volume context addressing the snapshot data, remotePath points to the snapshot directory
+	VolumeContext map[string]string `json:"volumeContext"`
+	// Secret of the source volume, the snapshot is read with it
+	SecretRef *v1.SecretReference `json:"secretRef,omitempty"`
+	// Set until the copy of the volume has finished, with the error of the last failed copy
+	Pending bool   `json:"pending,omitempty"`
+	Error   string `json:"error,omitempty"`
+}
+
+func (r *snapshotRecord) toCSI() (*csi.Snapshot, error) {
+	creationTime, err := ptypes.TimestampProto(r.CreationTime)
+	if err != nil {
+		return nil, err
+	}
+
+	return &csi.Snapshot{
+		SnapshotId:     r.SnapshotID,
+		SourceVolumeId: r.SourceVolumeID,
+		SizeBytes:      r.SizeBytes,
+		CreationTime:   creationTime,
+		ReadyToUse:     !r.Pending,
+	}, nil
+}
+
+// https://rclone.org/commands/rclone_size/
+type rcloneSizeResponse struct {
+	Count int64 `json:"count"`
+	Bytes int64 `json:"bytes"`
+}
+
+func (cs *controllerServer) CreateSnapshot(ctx context.Context, req *csi.CreateSnapshotRequest) (resp *csi.CreateSnapshotResponse, err error) {
+	defer func(start time.Time) { observeOperation("CreateSnapshot", start, err) }(time.Now())
+
+	snapshotID := req.GetName()
+	if snapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Name must be provided")
+	}
+	sourceVolumeID := req.GetSourceVolumeId()
+	if sourceVolumeID == "" {
+		return nil, status.Error(codes.InvalidArgument, "CreateSnapshot Source Volume ID must be provided")
+	}
+
+	// A retried call returns the snapshot created before, the snapshotter calls again until it is ready
+	record, err := getSnapshotRecord(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	if record != nil && record.SourceVolumeID != sourceVolumeID {
+		return nil, status.Errorf(codes.AlreadyExists, "snapshot %s already exists for volume %s", snapshotID, record.SourceVolumeID)
+	}
+
+	if record == nil || record.Pending {
+		pv, err := getPersistentVolume(sourceVolumeID)
+		if err != nil {
+			return nil, status.Errorf(codes.Internal, "can not load PV of volume %s: %s", sourceVolumeID, err)
+		}
+		if pv == nil {
+			return nil, status.Errorf(codes.NotFound, "volume %s not found", sourceVolumeID)
+		}
+		volumeContext := pv.Spec.CSI.VolumeAttributes
+
+		if record == nil {
+			if record, err = cs.newSnapshotRecord(snapshotID, sourceVolumeID, volumeContext, volumeSecretRef(pv), req.GetSecrets()); err != nil {
+				return nil, err
+			}
+		}
+
+		// The copy of a pending snapshot is started again after a failure or a controller restart
+		cs.startSnapshotCopy(record, volumeContext, req.GetSecrets())
+		if record.Error != "" {
+			return nil, status.Errorf(codes.Internal, "failed to copy volume %s to snapshot %s, retrying: %s", sourceVolumeID, snapshotID, record.Error)
+		}
+	}
+
+	snapshot, err := record.toCSI()
+	if err != nil {
+		return nil, status.Error(codes.Internal, err.Error())
+	}
+
+	return &csi.CreateSnapshotResponse{Snapshot: snapshot}, nil
+}
+
+// newSnapshotRecord records a pending snapshot of the volume, its data is copied by startSnapshotCopy
+func (cs *controllerServer) newSnapshotRecord(snapshotID string, sourceVolumeID string, volumeContext map[string]string, secretRef *v1.SecretReference, secrets map[string]string) (*snapshotRecord, error) {
+	remotePathSuffix := volumeContext["remotePathSuffix"]
+	// The snapshot directory would be inside of a volume without a per-volume path
+	if remotePathSuffix == "" {
+		return nil, status.Errorf(codes.FailedPrecondition, "volume %s has no remotePathSuffix, only volumes provisioned with a pathPattern can be snapshotted", sourceVolumeID)
+	}
+
+	_, remotePath, _, _, err := cs.getRemoteFlags(volumeContext, secrets)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshotContext := map[string]string{}
+	for k, v := range volumeContext {
+		snapshotContext[k] = v
+	}
+	snapshotContext["remotePath"] = fmt.Sprintf("%s/%s/%s", strings.TrimSuffix(remotePath, remotePathSuffix), snapshotsDir, snapshotID)
+	delete(snapshotContext, "remotePathSuffix")
+	delete(snapshotContext, "onDelete")
+
+	// The snapshot must stay readable after the key of the source volume is deleted
+	if volumeContext[encryptionParameter] == encryptionCrypt {
+		sourceKey, err := getCryptKeySecret(volumeContext)
+		if err != nil {
+			return nil, err
+		}
+		key, err := createCryptKeySecret(snapshotID, sourceKey.Namespace, sourceKey)
+		if err != nil {
+			return nil, err
+		}
+		snapshotContext[encryptionKeySecretNameParameter] = key.Name
+		snapshotContext[encryptionKeySecretNamespaceParameter] = key.Namespace
+	}
+
+	record := &snapshotRecord{
+		SnapshotID:     snapshotID,
+		SourceVolumeID: sourceVolumeID,
+		CreationTime:   time.Now().UTC(),
+		VolumeContext:  snapshotContext,
+		SecretRef:      secretRef,
+		Pending:        true,
+	}
+	if err := createRecord(snapshotRecordName(snapshotID), snapshotRecordLabel, snapshotRecordKey, record); err != nil {
+		if status.Code(err) == codes.AlreadyExists {
+			return nil, status.Errorf(codes.Aborted, "snapshot %s is already being created", snapshotID)
+		}
+		return nil, err
+	}
+
+	return record, nil
+}
+
+// startSnapshotCopy copies the volume to the directory of a pending snapshot in the background, unless
+// a copy is already running. The record is ready when the copy has finished.
+func (cs *controllerServer) startSnapshotCopy(record *snapshotRecord, volumeContext map[string]string, secrets map[string]string) {
+	ctx, ok := cs.startBackgroundOperation(record.SnapshotID)
+	if !ok {
+		return
+	}
+
+	go func() {
+		defer cs.finishOperation(record.SnapshotID)
+
+		size, err := cs.copySnapshotData(ctx, record, volumeContext, secrets)
+
+		update := *record
+		if err != nil {
+			update.Error = err.Error()
+		} else {
+			update.Pending = false
+			update.Error = ""
+			update.SizeBytes = size
+		}
+		if err := updateRecord(snapshotRecordName(record.SnapshotID), snapshotRecordKey, &update); err != nil {
+			glog.Errorf("Cannot update record of snapshot %s: %v", record.SnapshotID, err)
+		}
+	}()
+}
+
+// copySnapshotData copies the volume to the snapshot directory and returns the snapshot size
+func (cs *controllerServer) copySnapshotData(ctx context.Context, record *snapshotRecord, volumeContext map[string]string, secrets map[string]string) (int64, error) {
+	remote, remotePath, configData, flags, err := cs.getRemoteFlags(volumeContext, secrets)
+	if err != nil {
+		return 0, err
+	}
+
+	sourceWithPath := getRemoteWithPath(remote, remotePath, configData)
+	snapshotWithPath := getRemoteWithPath(remote, record.VolumeContext["remotePath"], configData)
+
+	// Same remote copies are server-side on backends supporting it
+	glog.Infof("Creating snapshot %s of volume %s: copying %s to %s", record.SnapshotID, record.SourceVolumeID, sourceWithPath, snapshotWithPath)
+	if _, err := RcloneCommand(ctx, configData, flags, "copy", sourceWithPath, snapshotWithPath, "--create-empty-src-dirs"); err != nil {
+		glog.Errorf("Failed to copy %s to %s: %v", sourceWithPath, snapshotWithPath, err)
+		return 0, err
+	}
+	glog.Infof("Snapshot %s of volume %s is ready", record.SnapshotID, record.SourceVolumeID)
+
+	var size rcloneSizeResponse
+	out, err := RcloneCommand(ctx, configData, flags, "size", "--json", snapshotWithPath)
+	if err == nil {
+		err = json.Unmarshal([]byte(out), &size)
+	}
+	if err != nil {
+		glog.Warningf("Cannot get size of snapshot %s: %v", record.SnapshotID, err)
+	}
+
+	return size.Bytes, nil
+}
+
+func (cs *controllerServer) DeleteSnapshot(ctx context.Context, req *csi.DeleteSnapshotRequest) (resp *csi.DeleteSnapshotResponse, err error) {
+	defer func(start time.Time) { observeOperation("DeleteSnapshot", start, err) }(time.Now())
+
+	snapshotID := req.GetSnapshotId()
+	if snapshotID == "" {
+		return nil, status.Error(codes.InvalidArgument, "DeleteSnapshot Snapshot ID must be provided")
+	}
+
+	// A running copy is stopped first, it would write into the purged directory
+	if cs.cancelOperation(snapshotID) {
+		return nil, status.Errorf(codes.Aborted, "copy of snapshot %s is being stopped", snapshotID)
+	}
+	if !cs.startOperation(snapshotID) {
+		return nil, status.Errorf(codes.Aborted, "an operation on snapshot %s is already in progress", snapshotID)
+	}
+	defer cs.finishOperation(snapshotID)
+
+	record, err := getSnapshotRecord(snapshotID)
+	if err != nil {
+		return nil, err
+	}
+	if record == nil {
+		glog.V(4).Infof("No record found for snapshot %s, nothing to delete", snapshotID)
+		return &csi.DeleteSnapshotResponse{}, nil
+	}
+
+	remote, remotePath, configData, flags, err := cs.getRemoteFlags(record.VolumeContext, req.GetSecrets())
+	if err != nil {
+		return nil, err
+	}
+	snapshotWithPath := getRemoteWithPath(remote, remotePath, configData)
+
+	glog.Infof("Purging %s of snapshot %s", snapshotWithPath, snapshotID)
+	if _, err := RcloneCommand(ctx, configData, flags, "purge", snapshotWithPath); err != nil && !isDirNotFound(err) {
+		glog.Errorf("Failed to purge snapshot %s: %v", snapshotID, err)
+		return nil, status.Errorf(codes.Internal, "failed to delete snapshot %s: %s", snapshotID, err)
+	}
+
+	if keyName := record.VolumeContext[encryptionKeySecretNameParameter]; keyName != "" {
+		namespace, err := cryptKeySecretNamespace(record.VolumeContext)
+		if err != nil {
+			return nil, err
+		}
+		if err := deleteCryptKeySecret(keyName, namespace); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := deleteSnapshotRecord(snapshotID); err != nil {
+		return nil, err
+	}
+
+	return &csi.DeleteSnapshotResponse{}, nil
+}
+
+func (cs *controllerServer) ListSnapshots(ctx context.Context, req *csi.ListSnapshotsRequest) (resp *csi.ListSnapshotsResponse, err error) {
+	defer func(start time.Time) { observeOperation("ListSnapshots", start, err) }(time.Now())
+
+	records, err := listSnapshotRecords()
+	if err != nil {
+		return nil, err
+	}
+
+	// Tokens are offsets into the list sorted by snapshot ID
+	sort.Slice(records, func(i, j int) bool { return records[i].SnapshotID < records[j].SnapshotID })
+
+	entries := []*csi.ListSnapshotsResponse_Entry{}
+	for _, record := range records {
+		if req.GetSnapshotId() != "" && record.SnapshotID != req.GetSnapshotId() {
+			continue
+		}
+		if req.GetSourceVolumeId() != "" && record.SourceVolumeID != req.GetSourceVolumeId() {
+			continue
+		}
+		snapshot, err := record.toCSI()
+		if err != nil {
+			return nil, status.Error(codes.Internal, err.Error())
+		}
+		entries = append(entries, &csi.ListSnapshotsResponse_Entry{Snapshot: snapshot})
+	}
+
+	start := 0
+	if token := req.GetStartingToken(); token != "" {
+		if start, err = strconv.Atoi(token); err != nil || start < 0 || start > len(entries) {
+			return nil, status.Errorf(codes.Aborted, "invalid starting token %q", token)
+		}
+	}
+	entries = entries[start:]
+
+	nextToken := ""
+	if maxEntries := int(req.GetMaxEntries()); maxEntries > 0 && len(entries) > maxEntries {
+		entries = entries[:maxEntries]
+		nextToken = strconv.Itoa(start + maxEntries)
+	}
+
+	return &csi.ListSnapshotsResponse{
+		Entries:   entries,
+		NextToken: nextToken,
+	}, nil
+}
+
+func snapshotRecordName(snapshotID string) string {
+	return snapshotRecordPrefix + snapshotID
+}
+
+// getSnapshotRecord loads the record of a snapshot, nil if it does not exist
+func getSnapshotRecord(snapshotID string) (*snapshotRecord, error) {
+	var record snapshotRecord
+	found, err := getRecord(snapshotRecordName(snapshotID), snapshotRecordKey, &record)
+	if err != nil || !found {
+		return nil, err
+	}
+	return &record, nil
+}
+
+func deleteSnapshotRecord(snapshotID string) error {
+	return deleteRecord(snapshotRecordName(snapshotID))
+}
+
+func listSnapshotRecords() ([]*snapshotRecord, error) {
+	configMaps, err := listRecords(snapshotRecordLabel)
+	if err != nil {
+		return nil, err
+	}
+
+	records := make([]*snapshotRecord, 0, len(configMaps))
+	for i := range configMaps {
+		var record snapshotRecord
+		if err := parseRecord(&configMaps[i], snapshotRecordKey, &record); err != nil {
+			glog.Warningf("Skipping snapshot record: %v", err)
+			continue
+		}
+		records = append(records, &record)
+	}
+
+	return records, nil
+}
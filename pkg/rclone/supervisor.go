@@ -0,0 +1,288 @@
+package rclone
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/golang/glog"
+)
+
+const (
+	// mountReadyTimeout matches the rclone --daemon-wait default
+	mountReadyTimeout = 60 * time.Second
+	// stopTimeout is how long rclone gets to unmount after SIGTERM before it is killed
+	stopTimeout = 30 * time.Second
+
+	restartMinBackoff = 1 * time.Second
+	restartMaxBackoff = 5 * time.Minute
+	// A process running longer than this is considered healthy again, resetting the backoff
+	restartResetAfter = 10 * time.Minute
+
+	// Number of rclone output lines kept for error messages
+	outputLines = 20
+)
+
+// rcloneProcess runs rclone mount as a foreground child process and restarts it with backoff when it crashes
+type rcloneProcess struct {
+	volumeID   string
+	targetPath string
+	rcAddr     string
+	args       []string
+	env        []string
+	configDir  string
+	configData string
+
+	mu         sync.Mutex
+	cmd        *exec.Cmd
+	exited     chan error
+	startedAt  time.Time
+	output     []string
+	restarting bool
+	// Called after rclone was restarted, the new mount is not bind mounted to the pods yet
+	onRestart func()
+
+	stop     chan struct{}
+	stopOnce sync.Once
+	stopped  chan struct{}
+}
+
+func newRcloneProcess(volumeID string, targetPath string, rcAddr string, args []string, env []string, configDir string, configData string) *rcloneProcess {
+	return &rcloneProcess{
+		volumeID:   volumeID,
+		targetPath: targetPath,
+		rcAddr:     rcAddr,
+		args:       args,
+		env:        env,
+		configDir:  configDir,
+		configData: configData,
+		stop:       make(chan struct{}),
+		stopped:    make(chan struct{}),
+	}
+}
+
+// start runs rclone and waits until the mount is ready
+func (p *rcloneProcess) start() error {
+	args := append([]string{}, p.args...)
+
+	// rclone reads the config file on startup only, it is removed as soon as the mount is ready
+	if p.configData != "" {
+		configFile, err := writeConfigFile(p.configDir, p.configData)
+		if err != nil {
+			return err
+		}
+		defer os.Remove(configFile)
+
+		args = append(args, "--config", configFile)
+	}
+
+	cmd := exec.Command("rclone", args...)
+	cmd.Env = p.env
+
+	stdout, err := cmd.StdoutPipe()
+	if err != nil {
+		return err
+	}
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return err
+	}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+
+	// Wait must not be called before all output is read
+	exited := make(chan error, 1)
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go p.forwardOutput(stdout, &wg)
+	go p.forwardOutput(stderr, &wg)
+	go func() {
+		wg.Wait()
+		exited <- cmd.Wait()
+	}()
+
+	p.mu.Lock()
+	p.cmd = cmd
+	p.exited = exited
+	p.startedAt = time.Now()
+	p.mu.Unlock()
+
+	return p.waitReady(cmd, exited)
+}
+
+// waitReady polls the mount table until the target is mounted
+func (p *rcloneProcess) waitReady(cmd *exec.Cmd, exited chan error) error {
+	timeout := time.After(mountReadyTimeout)
+	ticker := time.NewTicker(100 * time.Millisecond)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case err := <-exited:
+			return fmt.Errorf("rclone exited before the mount was ready: %v output: %q", err, p.lastOutput())
+		case <-timeout:
+			cmd.Process.Kill()
+			<-exited
+			return fmt.Errorf("mount was not ready within %s output: %q", mountReadyTimeout, p.lastOutput())
+		case <-ticker.C:
+			if mountPoints, err := getMountPoints(); err == nil && mountPoints[p.targetPath] {
+				glog.V(4).Infof("[%s] rclone mount (pid %d) is ready at %s", p.volumeID, cmd.Process.Pid, p.targetPath)
+				return nil
+			}
+		}
+	}
+}
+
+// forwardOutput streams rclone output into glog, prefixed with the volume ID
+func (p *rcloneProcess) forwardOutput(r io.Reader, wg *sync.WaitGroup) {
+	defer wg.Done()
+
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := scanner.Text()
+		glog.Infof("[%s] %s", p.volumeID, line)
+
+		p.mu.Lock()
+		p.output = append(p.output, line)
+		if len(p.output) > outputLines {
+			p.output = p.output[len(p.output)-outputLines:]
+		}
+		p.mu.Unlock()
+	}
+}
+
+func (p *rcloneProcess) lastOutput() string {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return strings.Join(p.output, "\n")
+}
+
+func (p *rcloneProcess) pid() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.cmd == nil || p.cmd.Process == nil {
+		return 0
+	}
+	return p.cmd.Process.Pid
+}
+
+// isRestarting reports whether rclone crashed and is waiting to be restarted
+func (p *rcloneProcess) isRestarting() bool {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.restarting
+}
+
+func (p *rcloneProcess) setRestarting(restarting bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.restarting = restarting
+}
+
+func (p *rcloneProcess) setOnRestart(onRestart func()) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.onRestart = onRestart
+}
+
+// supervise restarts rclone until Stop is called
+func (p *rcloneProcess) supervise() {
+	defer close(p.stopped)
+
+	backoff := restartMinBackoff
+	for {
+		p.mu.Lock()
+		exited := p.exited
+		p.mu.Unlock()
+
+		var err error
+		select {
+		case err = <-exited:
+		case <-p.stop:
+			p.terminate(exited)
+			return
+		}
+
+		p.mu.Lock()
+		if time.Since(p.startedAt) > restartResetAfter {
+			backoff = restartMinBackoff
+		}
+		p.mu.Unlock()
+
+		glog.Warningf("[%s] rclone exited unexpectedly: %v", p.volumeID, err)
+		p.setRestarting(true)
+
+		for {
+			glog.Infof("[%s] restarting rclone in %s", p.volumeID, backoff)
+			select {
+			case <-p.stop:
+				return
+			case <-time.After(backoff):
+			}
+
+			backoff *= 2
+			if backoff > restartMaxBackoff {
+				backoff = restartMaxBackoff
+			}
+
+			// The crashed process leaves a "transport endpoint is not connected" mount behind
+			lazyUnmount(p.targetPath)
+
+			if err := p.start(); err != nil {
+				glog.Errorf("[%s] restarting rclone failed: %v", p.volumeID, err)
+				continue
+			}
+			break
+		}
+
+		p.setRestarting(false)
+		glog.Infof("[%s] rclone restarted (pid %d)", p.volumeID, p.pid())
+
+		// The callback takes the mount lock, Stop may be waiting for supervise while holding it
+		p.mu.Lock()
+		onRestart := p.onRestart
+		p.mu.Unlock()
+		if onRestart != nil {
+			go onRestart()
+		}
+	}
+}
+
+// terminate sends SIGTERM, rclone unmounts the target before exiting, and kills it after stopTimeout
+func (p *rcloneProcess) terminate(exited chan error) {
+	p.mu.Lock()
+	process := p.cmd.Process
+	p.mu.Unlock()
+
+	process.Signal(syscall.SIGTERM)
+	select {
+	case <-exited:
+	case <-time.After(stopTimeout):
+		glog.Warningf("[%s] rclone did not exit within %s, killing it", p.volumeID, stopTimeout)
+		process.Kill()
+		<-exited
+	}
+}
+
+// Stop terminates rclone without restarting it and waits for it to exit
+func (p *rcloneProcess) Stop() {
+	p.stopOnce.Do(func() {
+		close(p.stop)
+	})
+	<-p.stopped
+}
+
+// lazyUnmount detaches a mount even if open files of running pods keep it busy
+func lazyUnmount(targetPath string) {
+	if out, err := exec.Command("umount", "-l", targetPath).CombinedOutput(); err != nil {
+		glog.V(4).Infof("Unmounting %s: %v %s", targetPath, err, strings.TrimSpace(string(out)))
+	}
+}
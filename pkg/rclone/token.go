@@ -0,0 +1,144 @@
+package rclone
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/golang/glog"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+// Service account tokens requested by the CSIDriver tokenRequests, passed by kubelet on publish
+const serviceAccountTokensParameter = "csi.storage.k8s.io/serviceAccount.tokens"
+
+// Volume context keys of service account token federation, they are not rclone flags
+const (
+	tokenAudienceParameter       = "tokenAudience"
+	tokenProviderParameter       = "tokenProvider"
+	awsRoleArnParameter          = "awsRoleArn"
+	azureClientIDParameter       = "azureClientId"
+	azureTenantIDParameter       = "azureTenantId"
+	gcpCredentialConfigParameter = "gcpCredentialConfig"
+)
+
+var tokenFederationParameters = []string{
+	tokenAudienceParameter,
+	tokenProviderParameter,
+	awsRoleArnParameter,
+	azureClientIDParameter,
+	azureTenantIDParameter,
+	gcpCredentialConfigParameter,
+}
+
+// tokenProvider values, the cloud the service account token is exchanged with
+const (
+	tokenProviderAWS   = "aws"
+	tokenProviderAzure = "azure"
+	tokenProviderGCP   = "gcp"
+)
+
+// https://kubernetes-csi.github.io/docs/token-requests.html
+type serviceAccountToken struct {
+	Token string `json:"token"`
+}
+
+// usesServiceAccountToken returns whether the volume authenticates with the pod service account token
+func usesServiceAccountToken(volumeContext map[string]string) bool {
+	return volumeContext[tokenAudienceParameter] != ""
+}
+
+// mountTokenDir returns the directory of the service account token of the mount at targetPath.
+// Unlike the config file the token is read by rclone whenever its credentials expire, it is
+// kept until the volume is unpublished.
+func mountTokenDir(stateDir string, targetPath string) string {
+	return filepath.Join(stateDir, "tokens", mountID(targetPath))
+}
+
+// writeServiceAccountToken writes the token of the volume audience to the token file of the mount,
+// kubelet passes a fresh token on every republish
+func writeServiceAccountToken(stateDir string, targetPath string, volumeContext map[string]string) error {
+	audience := volumeContext[tokenAudienceParameter]
+
+	tokens := map[string]serviceAccountToken{}
+	if err := json.Unmarshal([]byte(volumeContext[serviceAccountTokensParameter]), &tokens); err != nil {
+		return status.Errorf(codes.InvalidArgument, "no service account tokens passed by kubelet, add audience %s to the CSIDriver tokenRequests", audience)
+	}
+	token, ok := tokens[audience]
+	if !ok || token.Token == "" {
+		return status.Errorf(codes.InvalidArgument, "no service account token for audience %s, add it to the CSIDriver tokenRequests", audience)
+	}
+
+	dir := mountTokenDir(stateDir, targetPath)
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return status.Errorf(codes.Internal, "can not create token directory: %s", err)
+	}
+
+	// rclone may read the token while it is replaced
+	tmpFile := filepath.Join(dir, "token.tmp")
+	if err := ioutil.WriteFile(tmpFile, []byte(token.Token), 0600); err != nil {
+		return status.Errorf(codes.Internal, "can not write service account token: %s", err)
+	}
+	if err := os.Rename(tmpFile, filepath.Join(dir, "token")); err != nil {
+		return status.Errorf(codes.Internal, "can not write service account token: %s", err)
+	}
+
+	glog.V(4).Infof("Wrote service account token for audience %s of mount %s", audience, targetPath)
+	return nil
+}
+
+// applyTokenFederation configures the backend to exchange the service account token of the mount for
+// cloud credentials, with the web identity settings of the cloud SDKs
+func applyTokenFederation(stateDir string, targetPath string, volumeContext map[string]string, flags map[string]string, env map[string]string) error {
+	dir := mountTokenDir(stateDir, targetPath)
+	tokenFile := filepath.Join(dir, "token")
+
+	switch provider := volumeContext[tokenProviderParameter]; provider {
+	case tokenProviderAWS:
+		if volumeContext[awsRoleArnParameter] == "" {
+			return status.Errorf(codes.InvalidArgument, "tokenProvider %s requires %s", provider, awsRoleArnParameter)
+		}
+		env["AWS_ROLE_ARN"] = volumeContext[awsRoleArnParameter]
+		env["AWS_WEB_IDENTITY_TOKEN_FILE"] = tokenFile
+		env["AWS_ROLE_SESSION_NAME"] = DriverName
+		flags["s3-env-auth"] = "true"
+	case tokenProviderAzure:
+		if volumeContext[azureClientIDParameter] == "" || volumeContext[azureTenantIDParameter] == "" {
+			return status.Errorf(codes.InvalidArgument, "tokenProvider %s requires %s and %s", provider, azureClientIDParameter, azureTenantIDParameter)
+		}
+		env["AZURE_CLIENT_ID"] = volumeContext[azureClientIDParameter]
+		env["AZURE_TENANT_ID"] = volumeContext[azureTenantIDParameter]
+		env["AZURE_FEDERATED_TOKEN_FILE"] = tokenFile
+		flags["azureblob-env-auth"] = "true"
+	case tokenProviderGCP:
+		// The credential configuration of the workload identity pool, its token source is the mount token file
+		config := map[string]interface{}{}
+		if err := json.Unmarshal([]byte(volumeContext[gcpCredentialConfigParameter]), &config); err != nil {
+			return status.Errorf(codes.InvalidArgument, "tokenProvider %s requires the workload identity credential configuration in %s: %s", provider, gcpCredentialConfigParameter, err)
+		}
+		config["credential_source"] = map[string]string{"file": tokenFile}
+		data, err := json.Marshal(config)
+		if err != nil {
+			return status.Errorf(codes.Internal, "can not write credential configuration: %s", err)
+		}
+		credentialsFile := filepath.Join(dir, "credentials.json")
+		if err := ioutil.WriteFile(credentialsFile, data, 0600); err != nil {
+			return status.Errorf(codes.Internal, "can not write credential configuration: %s", err)
+		}
+		env["GOOGLE_APPLICATION_CREDENTIALS"] = credentialsFile
+		flags["gcs-env-auth"] = "true"
+	default:
+		return status.Errorf(codes.InvalidArgument, "invalid tokenProvider %q, must be one of: %s, %s, %s", provider, tokenProviderAWS, tokenProviderAzure, tokenProviderGCP)
+	}
+
+	return nil
+}
+
+// removeTokenDir deletes the service account token of an unpublished mount
+func removeTokenDir(dir string) {
+	if err := os.RemoveAll(dir); err != nil {
+		glog.Warningf("cannot remove service account token directory %s: %v", dir, err)
+	}
+}
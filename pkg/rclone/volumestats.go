@@ -0,0 +1,105 @@
+package rclone
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"syscall"
+
+	"github.com/container-storage-interface/spec/lib/go/csi"
+	"golang.org/x/net/context"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+)
+
+func (ns *nodeServer) NodeGetVolumeStats(ctx context.Context, req *csi.NodeGetVolumeStatsRequest) (*csi.NodeGetVolumeStatsResponse, error) {
+	volumePath := req.GetVolumePath()
+	if len(volumePath) == 0 {
+		return nil, status.Error(codes.InvalidArgument, "NodeGetVolumeStats Volume Path must be provided")
+	}
+
+	// A hung mount is reported abnormal, kubelet polls the stats of every volume
+	err := probeMount(volumePath, "stats", func() error { return checkMountpoint(volumePath) })
+	if os.IsNotExist(err) {
+		return nil, status.Errorf(codes.NotFound, "volume path %s does not exist", volumePath)
+	}
+	if err != nil {
+		return volumeStatsResponse(nil, fmt.Sprintf("mount is stale: %v", err)), nil
+	}
+
+	mc := ns.lookupMountContext(volumePath)
+	if mc.RcAddr == "" {
+		usage, _ := statfsVolumeUsage(volumePath)
+		return volumeStatsResponse(usage, "rclone process of the mount is not tracked by the nodeplugin"), nil
+	}
+
+	var vfsStats rcVfsStatsResponse
+	out, err := RcloneRPC(mc.RcAddr, "vfs/stats", "{}")
+	if err == nil {
+		err = json.Unmarshal([]byte(out), &vfsStats)
+	}
+	if err != nil {
+		usage, _ := statfsVolumeUsage(volumePath)
+		return volumeStatsResponse(usage, fmt.Sprintf("rclone rc endpoint does not respond: %v", err)), nil
+	}
+
+	// operations/about reports the quota of the whole remote (i.e. the bucket), not of the volume path.
+	// The mount reports the volume capacity as its size when the volume has one.
+	usage, err := statfsVolumeUsage(volumePath)
+	if err != nil {
+		return volumeStatsResponse(nil, fmt.Sprintf("cannot get usage of the mount: %v", err)), nil
+	}
+
+	message := ""
+	if vfsStats.DiskCache.OutOfSpace {
+		message = "VFS cache is out of space"
+	} else if vfsStats.DiskCache.ErroredFiles > 0 {
+		message = fmt.Sprintf("%d files failed to upload from the VFS cache", vfsStats.DiskCache.ErroredFiles)
+	}
+
+	return volumeStatsResponse(usage, message), nil
+}
+
+// volumeStatsResponse builds the stats response, a non-empty message marks the volume abnormal
+func volumeStatsResponse(usage []*csi.VolumeUsage, abnormalMessage string) *csi.NodeGetVolumeStatsResponse {
+	condition := &csi.VolumeCondition{
+		Abnormal: false,
+		Message:  "volume is healthy",
+	}
+	if abnormalMessage != "" {
+		condition = &csi.VolumeCondition{
+			Abnormal: true,
+			Message:  abnormalMessage,
+		}
+	}
+
+	return &csi.NodeGetVolumeStatsResponse{
+		Usage:           usage,
+		VolumeCondition: condition,
+	}
+}
+
+// statfsVolumeUsage returns the usage reported by the FUSE mount itself, the total is the volume capacity
+// (--vfs-disk-space-total-size), the other values are taken from the remote
+func statfsVolumeUsage(volumePath string) ([]*csi.VolumeUsage, error) {
+	var statfs syscall.Statfs_t
+	if err := probeMount(volumePath, "statfs", func() error { return syscall.Statfs(volumePath, &statfs) }); err != nil {
+		return nil, err
+	}
+
+	blockSize := int64(statfs.Bsize)
+	return []*csi.VolumeUsage{
+		{
+			Unit:      csi.VolumeUsage_BYTES,
+			Total:     int64(statfs.Blocks) * blockSize,
+			Used:      int64(statfs.Blocks-statfs.Bfree) * blockSize,
+			Available: int64(statfs.Bavail) * blockSize,
+		},
+		{
+			Unit:      csi.VolumeUsage_INODES,
+			Total:     int64(statfs.Files),
+			Used:      int64(statfs.Files - statfs.Ffree),
+			Available: int64(statfs.Ffree),
+		},
+	}, nil
+}